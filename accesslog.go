@@ -0,0 +1,268 @@
+package http1
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+const defaultAccessLogQueue = 1024
+
+type AccessLogFormat int
+
+const (
+	// LogCombined is the Apache Combined format followed by the duration
+	// in microseconds and the keep-alive request index
+	LogCombined AccessLogFormat = iota
+	// LogJSON writes one JSON object per line
+	LogJSON
+)
+
+// AccessEntry describes a finished transaction, the slices are only valid during Log
+type AccessEntry struct {
+	Time          time.Time
+	Method        []byte
+	URI           []byte
+	Proto         []byte
+	Status        int
+	BytesSent     int64
+	BytesReceived int
+	Duration      time.Duration
+	RemoteAddr    net.Addr
+	//RequestNum is the index of the request on its keep-alive connection, from 1
+	RequestNum uint64
+	UserAgent  []byte
+	Referer    []byte
+	User       string
+}
+
+// AccessLogger formats entries on the serving goroutine and writes them
+// from its own goroutine through a buffered writer. Entries are dropped
+// while the queue is full rather than blocking the server
+type AccessLogger struct {
+	format  AccessLogFormat
+	w       *bufio.Writer
+	entries chan *bytebufferpool.ByteBuffer
+	done    chan struct{}
+	err     error
+	dropped uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var accessLogPool bytebufferpool.Pool
+
+// NewAccessLogger writes to w in format, queue <= 0 queues up to 1024 entries
+func NewAccessLogger(w io.Writer, format AccessLogFormat, queue int) *AccessLogger {
+	if queue <= 0 {
+		queue = defaultAccessLogQueue
+	}
+	l := &AccessLogger{
+		format:  format,
+		w:       bufio.NewWriterSize(w, 32*1024),
+		entries: make(chan *bytebufferpool.ByteBuffer, queue),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *AccessLogger) run() {
+	for buf := range l.entries {
+		if _, err := l.w.Write(buf.B); err != nil && l.err == nil {
+			l.err = err
+		}
+		accessLogPool.Put(buf)
+		//flush once the queue is drained, bursts share a write
+		if len(l.entries) == 0 {
+			if err := l.w.Flush(); err != nil && l.err == nil {
+				l.err = err
+			}
+		}
+	}
+	close(l.done)
+}
+
+// Log formats e and queues the line
+func (l *AccessLogger) Log(e *AccessEntry) {
+	buf := accessLogPool.Get()
+	if l.format == LogJSON {
+		buf.B = appendAccessJSON(buf.B[:0], e)
+	} else {
+		buf.B = appendAccessCombined(buf.B[:0], e)
+	}
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		accessLogPool.Put(buf)
+		return
+	}
+	select {
+	case l.entries <- buf:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		accessLogPool.Put(buf)
+	}
+	l.mu.RUnlock()
+}
+
+// Dropped returns the number of entries lost to a full queue
+func (l *AccessLogger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes the queued entries and stops the logger, it returns the first write error
+func (l *AccessLogger) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.entries)
+	}
+	l.mu.Unlock()
+	<-l.done
+	return l.err
+}
+
+func (ctx *Context) logAccess() {
+	e := AccessEntry{
+		Time:          ctx.start,
+		Method:        ctx.req.header.Method,
+		URI:           ctx.req.header.URI,
+		Proto:         ctx.req.header.Proto,
+		Status:        ctx.resp.header.StatusCode,
+		BytesSent:     ctx.resp.sent,
+		BytesReceived: ctx.req.wireSize,
+		Duration:      time.Since(ctx.start),
+		RemoteAddr:    ctx.RemoteAddr(),
+		RequestNum:    ctx.connRequestNum,
+		UserAgent:     ctx.req.header.UserAgent(),
+		Referer:       ctx.req.header.Referer(),
+		User:          ctx.authUser,
+	}
+	if ctx.head {
+		e.Method = byteHead
+	}
+	ctx.s.AccessLog.Log(&e)
+}
+
+func appendAccessCombined(b []byte, e *AccessEntry) []byte {
+	b = append(b, remoteIP(e.RemoteAddr)...)
+	b = append(b, " - "...)
+	b = appendLogField(b, s2b(e.User))
+	b = append(b, " ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, `] "`...)
+	b = appendLogEscaped(b, e.Method)
+	b = append(b, ' ')
+	b = appendLogEscaped(b, e.URI)
+	b = append(b, ' ')
+	b = appendLogEscaped(b, e.Proto)
+	b = append(b, `" `...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.BytesSent > 0 {
+		b = strconv.AppendInt(b, e.BytesSent, 10)
+	} else {
+		b = append(b, '-')
+	}
+	b = append(b, ` "`...)
+	b = appendLogField(b, e.Referer)
+	b = append(b, `" "`...)
+	b = appendLogField(b, e.UserAgent)
+	b = append(b, `" `...)
+	b = strconv.AppendInt(b, int64(e.Duration/time.Microsecond), 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, e.RequestNum, 10)
+	return append(b, '\n')
+}
+
+func appendLogField(b, v []byte) []byte {
+	if len(v) == 0 {
+		return append(b, '-')
+	}
+	return appendLogEscaped(b, v)
+}
+
+// appendLogEscaped escapes quotes, backslashes and bytes outside printable ASCII
+// as Apache does so a client can't forge log lines
+func appendLogEscaped(b, v []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	for _, c := range v {
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c >= 0x7f:
+			b = append(b, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+func appendAccessJSON(b []byte, e *AccessEntry) []byte {
+	b = append(b, `{"time":"`...)
+	b = e.Time.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, `","remote_addr":`...)
+	b = appendJSONString(b, s2b(remoteIP(e.RemoteAddr)))
+	b = append(b, `,"user":`...)
+	b = appendJSONString(b, s2b(e.User))
+	b = append(b, `,"method":`...)
+	b = appendJSONString(b, e.Method)
+	b = append(b, `,"uri":`...)
+	b = appendJSONString(b, e.URI)
+	b = append(b, `,"proto":`...)
+	b = appendJSONString(b, e.Proto)
+	b = append(b, `,"status":`...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, `,"bytes_sent":`...)
+	b = strconv.AppendInt(b, e.BytesSent, 10)
+	b = append(b, `,"bytes_received":`...)
+	b = strconv.AppendInt(b, int64(e.BytesReceived), 10)
+	b = append(b, `,"duration_us":`...)
+	b = strconv.AppendInt(b, int64(e.Duration/time.Microsecond), 10)
+	b = append(b, `,"request_num":`...)
+	b = strconv.AppendUint(b, e.RequestNum, 10)
+	b = append(b, `,"referer":`...)
+	b = appendJSONString(b, e.Referer)
+	b = append(b, `,"user_agent":`...)
+	b = appendJSONString(b, e.UserAgent)
+	return append(b, "}\n"...)
+}
+
+// appendJSONString appends v as a JSON string, invalid UTF-8 becomes U+FFFD
+func appendJSONString(b, v []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(v); {
+		c := v[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(v[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `�`...)
+		} else {
+			b = append(b, v[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
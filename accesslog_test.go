@@ -0,0 +1,162 @@
+package http1
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAccessEntry() *AccessEntry {
+	return &AccessEntry{
+		Time:          time.Date(2020, 3, 4, 5, 6, 7, 0, time.FixedZone("", 3600)),
+		Method:        []byte("GET"),
+		URI:           []byte("/a?b"),
+		Proto:         []byte("HTTP/1.1"),
+		Status:        200,
+		BytesSent:     5,
+		BytesReceived: 40,
+		Duration:      1500 * time.Microsecond,
+		RemoteAddr:    &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		RequestNum:    2,
+		UserAgent:     []byte("ua"),
+		Referer:       []byte("http://r/"),
+		User:          "bob",
+	}
+}
+
+func TestAppendAccessCombined(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(e *AccessEntry)
+		want   string
+	}{
+		{"full", func(e *AccessEntry) {},
+			`10.0.0.1 - bob [04/Mar/2020:05:06:07 +0100] "GET /a?b HTTP/1.1" 200 5 "http://r/" "ua" 1500 2`},
+		{"empty fields", func(e *AccessEntry) { e.User, e.BytesSent, e.Referer, e.UserAgent = "", 0, nil, nil },
+			`10.0.0.1 - - [04/Mar/2020:05:06:07 +0100] "GET /a?b HTTP/1.1" 200 - "-" "-" 1500 2`},
+		{"escaped", func(e *AccessEntry) { e.URI, e.UserAgent = []byte(`/"x\`), []byte("a\n\xff") },
+			`10.0.0.1 - bob [04/Mar/2020:05:06:07 +0100] "GET /\"x\\ HTTP/1.1" 200 5 "http://r/" "a\x0a\xff" 1500 2`},
+		{"unix peer", func(e *AccessEntry) { e.RemoteAddr = &net.UnixAddr{Name: "@", Net: "unix"} },
+			`@ - bob [04/Mar/2020:05:06:07 +0100] "GET /a?b HTTP/1.1" 200 5 "http://r/" "ua" 1500 2`},
+	}
+	for _, tt := range tests {
+		e := testAccessEntry()
+		tt.modify(e)
+		if got := string(appendAccessCombined(nil, e)); got != tt.want+"\n" {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppendAccessJSON(t *testing.T) {
+	e := testAccessEntry()
+	e.UserAgent = []byte("a\"\x01\xffé")
+	line := appendAccessJSON(nil, e)
+	if line[len(line)-1] != '\n' {
+		t.Fatalf("line %q not terminated", line)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	want := map[string]interface{}{
+		"time": "2020-03-04T05:06:07+01:00", "remote_addr": "10.0.0.1", "user": "bob", "method": "GET",
+		"uri": "/a?b", "proto": "HTTP/1.1", "status": 200.0, "bytes_sent": 5.0, "bytes_received": 40.0,
+		"duration_us": 1500.0, "request_num": 2.0, "referer": "http://r/", "user_agent": "a\"\x01\ufffdé",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %#v, want %#v", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("fields %v", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer the logger goroutine can write while the test reads
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestAccessLogger(t *testing.T) {
+	var out syncBuffer
+	l := NewAccessLogger(&out, LogCombined, 0)
+	s := NewServer(func(ctx *Context) { ctx.Response().SetBody([]byte("hello")) }, 0)
+	s.AccessLog = l
+	serveString(s, "POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabcHEAD /b HTTP/1.1\r\nHost: a\r\nUser-Agent: x\r\n\r\n")
+	serveString(s, "GET / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: foo\r\n\r\n")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{
+		`"POST /a HTTP/1.1" 200 `,
+		`"HEAD /b HTTP/1.1" 200 `,
+		`"GET / HTTP/1.1" 501 `,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("lines %q", lines)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(lines[i], "10.0.0.1 - - [") || !strings.Contains(lines[i], w) {
+			t.Errorf("line %d %q, want %q", i, lines[i], w)
+		}
+	}
+	if !strings.HasSuffix(lines[0], " 1") || !strings.HasSuffix(lines[1], " 2") || !strings.Contains(lines[1], `"-" "x"`) {
+		t.Errorf("request index or user agent: %q", lines[:2])
+	}
+
+	//entries logged after Close are dropped quietly
+	l.Log(testAccessEntry())
+	if err := l.Close(); err != nil || strings.Count(out.String(), "\n") != 3 {
+		t.Errorf("Log after Close: %v %q", err, out.String())
+	}
+}
+
+// blockingWriter holds every write until release is closed
+type blockingWriter struct {
+	release chan struct{}
+	err     error
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), w.err
+}
+
+func TestAccessLoggerQueue(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{}), err: errors.New("disk full")}
+	l := NewAccessLogger(w, LogJSON, 2)
+	//the bufio writer only reaches w once 32KB are buffered
+	e := testAccessEntry()
+	e.UserAgent = bytes.Repeat([]byte("a"), 40*1024)
+	for i := 0; i < 10; i++ {
+		l.Log(e)
+	}
+	if n := l.Dropped(); n == 0 || n > 10 {
+		t.Errorf("Dropped() = %d with a blocked writer", n)
+	}
+	close(w.release)
+	if err := l.Close(); err == nil || err.Error() != "disk full" {
+		t.Errorf("Close() = %v, want the write error", err)
+	}
+}
@@ -0,0 +1,473 @@
+package http1
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultNonceTTL  = 5 * time.Minute
+	defaultMaxNonces = 1 << 16
+	nonceSize        = 24
+)
+
+var (
+	byteDigestSpace = []byte("Digest ")
+	byteQopAuth     = []byte("auth")
+
+	defaultDigestAlgorithms = []string{"SHA-256", "MD5"}
+)
+
+// CredentialStore looks up the password of a user for BasicAuth and DigestAuth
+type CredentialStore interface {
+	Password(user string) (password string, ok bool)
+}
+
+// StaticCredentials is a CredentialStore of user to password
+type StaticCredentials map[string]string
+
+func (c StaticCredentials) Password(user string) (string, bool) {
+	p, ok := c[user]
+	return p, ok
+}
+
+// AuthUser returns the user authenticated by BasicAuth or DigestAuth
+func (ctx *Context) AuthUser() string {
+	return ctx.authUser
+}
+
+// BasicAuth asks for 'Authorization: Basic' credentials found in Store
+type BasicAuth struct {
+	Realm string
+	Store CredentialStore
+
+	//challenge holds a *basicChallenge built from Realm
+	challenge atomic.Value
+}
+
+type basicChallenge struct {
+	realm string
+	value []byte
+}
+
+func NewBasicAuth(realm string, store CredentialStore) *BasicAuth {
+	return &BasicAuth{Realm: realm, Store: store}
+}
+
+// challengeValue returns the WWW-Authenticate value for Realm, it is built
+// again when Realm changed since the last call
+func (a *BasicAuth) challengeValue() []byte {
+	if c, _ := a.challenge.Load().(*basicChallenge); c != nil && c.realm == a.Realm {
+		return c.value
+	}
+	c := &basicChallenge{realm: a.Realm, value: []byte(`Basic realm=` + strconv.Quote(a.Realm) + `, charset="UTF-8"`)}
+	a.challenge.Store(c)
+	return c.value
+}
+
+// Middleware answers 401 with a Basic challenge unless the request carries
+// the password Store has for the user
+func (a *BasicAuth) Middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		user, password, ok := ctx.req.header.BasicAuth()
+		if ok && a.check(string(user), password) {
+			ctx.authUser = string(user)
+			next(ctx)
+			return
+		}
+		ctx.resp.header.Set(HeaderWWWAuthenticate, a.challengeValue())
+		unauthorized(ctx)
+	}
+}
+
+func (a *BasicAuth) check(user string, password []byte) bool {
+	want, ok := a.Store.Password(user)
+	//digests have the same length whatever the passwords, so the comparison
+	//doesn't leak the length and unknown users cost the same as known ones
+	wantSum, sum := sha256.Sum256(s2b(want)), sha256.Sum256(password)
+	match := subtle.ConstantTimeCompare(wantSum[:], sum[:]) == 1
+	return ok && match
+}
+
+func unauthorized(ctx *Context) {
+	ctx.resp.SetStatusCode(StatusUnauthorized)
+	ctx.resp.SetBody(s2b(reason(StatusUnauthorized)))
+}
+
+// DigestAuth asks for RFC 7616 Digest credentials with qop=auth.
+// Nonces carry their creation time and an HMAC of a random secret. The nonces
+// handed out are remembered with the highest nc each was used with, a request
+// must count up from it so a captured header can't be replayed. A nonce that is
+// expired or was forgotten is answered with stale=true.
+// Without NewDigestAuth only Store must be set, the secret is made when Middleware
+// is first called
+type DigestAuth struct {
+	Realm string
+	Store CredentialStore
+	//Algorithms are offered in order, "SHA-256" and "MD5" by default
+	Algorithms []string
+	//NonceTTL is how long a nonce is accepted, 5 minutes by default
+	NonceTTL time.Duration
+	//MaxNonces bounds the nonces remembered, the least recently used is forgotten
+	//first. 65536 by default
+	MaxNonces int
+
+	once   sync.Once
+	secret []byte
+	opaque string
+	nonces nonceCache
+}
+
+func NewDigestAuth(realm string, store CredentialStore) *DigestAuth {
+	a := &DigestAuth{
+		Realm:      realm,
+		Store:      store,
+		Algorithms: defaultDigestAlgorithms,
+		NonceTTL:   defaultNonceTTL,
+		MaxNonces:  defaultMaxNonces,
+	}
+	a.once.Do(a.init)
+	return a
+}
+
+func (a *DigestAuth) init() {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	a.secret = secret
+	a.opaque = hex.EncodeToString(secret[:8])
+}
+
+func (a *DigestAuth) algorithms() []string {
+	if len(a.Algorithms) == 0 {
+		return defaultDigestAlgorithms
+	}
+	return a.Algorithms
+}
+
+// Middleware answers 401 with one Digest challenge per algorithm unless
+// the request carries a valid response for the password Store has
+func (a *DigestAuth) Middleware(next HandlerFunc) HandlerFunc {
+	a.once.Do(a.init)
+	return func(ctx *Context) {
+		v := ctx.req.header.GetHeader(HeaderAuthorization)
+		stale := false
+		if hasPrefixFold(v, byteDigestSpace) {
+			var p digestParams
+			parseAuthParams(v[len(byteDigestSpace):], p.set)
+			var ok bool
+			if ok, stale = a.verify(ctx, &p); ok {
+				ctx.authUser = string(p.username)
+				next(ctx)
+				return
+			}
+		}
+		now := time.Now()
+		for _, alg := range a.algorithms() {
+			ctx.resp.header.Add(HeaderWWWAuthenticate, a.challenge(alg, now, stale))
+		}
+		unauthorized(ctx)
+	}
+}
+
+func (a *DigestAuth) challenge(alg string, now time.Time, stale bool) []byte {
+	b := make([]byte, 0, 160)
+	b = append(b, "Digest realm="...)
+	b = strconv.AppendQuote(b, a.Realm)
+	b = append(b, `, qop="auth", algorithm=`...)
+	b = append(b, alg...)
+	b = append(b, `, nonce="`...)
+	b = append(b, a.nonce(now)...)
+	b = append(b, `", opaque="`...)
+	b = append(b, a.opaque...)
+	b = append(b, '"')
+	if stale {
+		b = append(b, ", stale=true"...)
+	}
+	return b
+}
+
+// nonce is base64url(unix nanoseconds | HMAC-SHA256(secret, time|realm)[:16]),
+// it is remembered until used or forgotten
+func (a *DigestAuth) nonce(now time.Time) string {
+	var raw [nonceSize]byte
+	binary.BigEndian.PutUint64(raw[:8], uint64(now.UnixNano()))
+	copy(raw[8:], a.nonceMAC(raw[:8]))
+	a.nonces.add(raw, a.MaxNonces)
+	return base64.RawURLEncoding.EncodeToString(raw[:])
+}
+
+func (a *DigestAuth) nonceMAC(ts []byte) []byte {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write(ts)
+	m.Write(s2b(a.Realm))
+	return m.Sum(nil)[:16]
+}
+
+// checkNonce reports whether nonce was made by a, and whether it is past NonceTTL
+func (a *DigestAuth) checkNonce(nonce []byte, now time.Time) (raw [nonceSize]byte, valid, expired bool) {
+	n, err := base64.RawURLEncoding.Decode(raw[:], nonce)
+	if err != nil || n != len(raw) || !hmac.Equal(raw[8:], a.nonceMAC(raw[:8])) {
+		return raw, false, false
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8])))
+	ttl := a.NonceTTL
+	if ttl <= 0 {
+		ttl = defaultNonceTTL
+	}
+	return raw, true, now.Sub(created) > ttl
+}
+
+// verify returns whether p answers a challenge of a, stale is true when
+// only the nonce was too old
+func (a *DigestAuth) verify(ctx *Context, p *digestParams) (ok, stale bool) {
+	if len(p.username) == 0 || len(p.nonce) == 0 || len(p.response) == 0 ||
+		!bytes.Equal(p.qop, byteQopAuth) || len(p.nc) == 0 || len(p.cnonce) == 0 ||
+		b2s(p.realm) != a.Realm || !bytes.Equal(p.uri, ctx.req.header.URI) {
+		return false, false
+	}
+	alg := b2s(p.algorithm)
+	if alg == "" {
+		alg = "MD5"
+	}
+	newHash := a.hashFunc(alg)
+	if newHash == nil {
+		return false, false
+	}
+	nc, err := strconv.ParseUint(b2s(p.nc), 16, 32)
+	if err != nil || len(p.nc) != 8 {
+		return false, false
+	}
+	raw, valid, expired := a.checkNonce(p.nonce, time.Now())
+	if !valid {
+		return false, false
+	}
+	password, found := a.Store.Password(b2s(p.username))
+
+	h := newHash()
+	ha1 := digestHex(h, p.username, s2b(a.Realm), s2b(password))
+	method := ctx.req.header.Method
+	if ctx.head {
+		method = byteHead
+	}
+	ha2 := digestHex(h, method, p.uri)
+	want := digestHex(h, ha1, p.nonce, p.nc, p.cnonce, p.qop, ha2)
+	//unknown users cost the same comparison as known ones
+	match := subtle.ConstantTimeCompare(want, bytes.ToLower(p.response)) == 1
+	if !found || !match {
+		return false, false
+	}
+	if expired {
+		return false, true
+	}
+	switch a.nonces.use(raw, nc) {
+	case nonceUnknown:
+		return false, true
+	case nonceReplayed:
+		return false, false
+	}
+	return true, false
+}
+
+func (a *DigestAuth) hashFunc(alg string) func() hash.Hash {
+	for _, offered := range a.algorithms() {
+		if !equalFoldString(offered, alg) {
+			continue
+		}
+		switch {
+		case equalFoldString(alg, "SHA-256"):
+			return sha256.New
+		case equalFoldString(alg, "MD5"):
+			return md5.New
+		}
+	}
+	return nil
+}
+
+// digestHex is the lowercase hex of H(parts joined by ':')
+func digestHex(h hash.Hash, parts ...[]byte) []byte {
+	h.Reset()
+	for i, p := range parts {
+		if i > 0 {
+			h.Write(byteColon)
+		}
+		h.Write(p)
+	}
+	sum := h.Sum(nil)
+	dst := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(dst, sum)
+	return dst
+}
+
+const (
+	nonceFresh = iota
+	nonceUnknown
+	nonceReplayed
+)
+
+// nonceCache remembers nonces with the highest nc used with each, the least
+// recently used nonce is forgotten once max are kept
+type nonceCache struct {
+	mu      sync.Mutex
+	entries map[[nonceSize]byte]*nonceEntry
+	//head is the most recently used nonce, tail the next one to forget
+	head, tail *nonceEntry
+}
+
+type nonceEntry struct {
+	nonce      [nonceSize]byte
+	nc         uint64
+	prev, next *nonceEntry
+}
+
+func (c *nonceCache) add(nonce [nonceSize]byte, max int) {
+	if max <= 0 {
+		max = defaultMaxNonces
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[[nonceSize]byte]*nonceEntry)
+	}
+	if e := c.entries[nonce]; e != nil {
+		c.moveToFront(e)
+		return
+	}
+	var e *nonceEntry
+	for len(c.entries) >= max && c.tail != nil {
+		e = c.tail
+		c.unlink(e)
+		delete(c.entries, e.nonce)
+	}
+	if e == nil {
+		e = &nonceEntry{}
+	}
+	e.nonce, e.nc = nonce, 0
+	c.entries[nonce] = e
+	c.pushFront(e)
+}
+
+// use records nc for nonce, it must be higher than any count used with nonce before
+func (c *nonceCache) use(nonce [nonceSize]byte, nc uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[nonce]
+	if e == nil {
+		return nonceUnknown
+	}
+	if nc <= e.nc {
+		return nonceReplayed
+	}
+	e.nc = nc
+	c.moveToFront(e)
+	return nonceFresh
+}
+
+func (c *nonceCache) moveToFront(e *nonceEntry) {
+	if c.head == e {
+		return
+	}
+	c.unlink(e)
+	c.pushFront(e)
+}
+
+func (c *nonceCache) pushFront(e *nonceEntry) {
+	e.prev, e.next = nil, c.head
+	if c.head != nil {
+		c.head.prev = e
+	}
+	c.head = e
+	if c.tail == nil {
+		c.tail = e
+	}
+}
+
+func (c *nonceCache) unlink(e *nonceEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		c.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		c.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+type digestParams struct {
+	username, realm, nonce, uri, response []byte
+	algorithm, qop, nc, cnonce            []byte
+}
+
+func (p *digestParams) set(key, value []byte) {
+	switch k := b2s(key); {
+	case equalFoldString(k, "username"):
+		p.username = value
+	case equalFoldString(k, "realm"):
+		p.realm = value
+	case equalFoldString(k, "nonce"):
+		p.nonce = value
+	case equalFoldString(k, "uri"):
+		p.uri = value
+	case equalFoldString(k, "response"):
+		p.response = value
+	case equalFoldString(k, "algorithm"):
+		p.algorithm = value
+	case equalFoldString(k, "qop"):
+		p.qop = value
+	case equalFoldString(k, "nc"):
+		p.nc = value
+	case equalFoldString(k, "cnonce"):
+		p.cnonce = value
+	}
+}
+
+// parseAuthParams calls f for every key=value of an auth-param list,
+// quoted values are returned without quotes, escapes are kept
+func parseAuthParams(v []byte, f func(key, value []byte)) {
+	for {
+		v = bytes.TrimLeft(v, " \t,")
+		eq := bytes.IndexByte(v, '=')
+		if eq <= 0 {
+			return
+		}
+		key := bytes.TrimSpace(v[:eq])
+		v = bytes.TrimLeft(v[eq+1:], " \t")
+		var value []byte
+		if len(v) > 0 && v[0] == '"' {
+			end := 1
+			for end < len(v) && v[end] != '"' {
+				if v[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(v) {
+				return
+			}
+			value, v = v[1:end], v[end+1:]
+		} else {
+			end := bytes.IndexByte(v, ',')
+			if end < 0 {
+				end = len(v)
+			}
+			value, v = bytes.TrimSpace(v[:end]), v[end:]
+		}
+		f(key, value)
+	}
+}
@@ -0,0 +1,195 @@
+package http1
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCredentials = StaticCredentials{"bob": "secret"}
+
+func TestBasicAuth(t *testing.T) {
+	a := NewBasicAuth("admin", testCredentials)
+	s := NewServer(Chain(func(ctx *Context) { ctx.Response().SetBody([]byte("hi " + ctx.AuthUser())) }, a.Middleware), 0)
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"valid", "Authorization: Basic Ym9iOnNlY3JldA==\r\n", StatusOK},
+		{"wrong password", "Authorization: Basic Ym9iOnNlY3JldDI=\r\n", StatusUnauthorized},
+		{"unknown user", "Authorization: Basic YWxpY2U6c2VjcmV0\r\n", StatusUnauthorized},
+		{"password prefix", "Authorization: Basic Ym9iOnNlY3Jl\r\n", StatusUnauthorized},
+		{"longer password", "Authorization: Basic Ym9iOnNlY3JldCE=\r\n", StatusUnauthorized},
+		{"empty password", "Authorization: Basic Ym9iOg==\r\n", StatusUnauthorized},
+		{"invalid base64", "Authorization: Basic !!!\r\n", StatusUnauthorized},
+		{"missing", "", StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n"+tt.header+"\r\n")
+		resp := readResponses(t, out, "GET")[0]
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if tt.status == StatusOK && readBody(resp) != "hi bob" {
+			t.Errorf("%s: authenticated user not set", tt.name)
+		}
+		if tt.status == StatusUnauthorized && resp.Header.Get(HeaderWWWAuthenticate) != `Basic realm="admin", charset="UTF-8"` {
+			t.Errorf("%s: challenge %q", tt.name, resp.Header.Get(HeaderWWWAuthenticate))
+		}
+	}
+}
+
+func TestBasicAuthRealm(t *testing.T) {
+	a := &BasicAuth{Realm: "one", Store: testCredentials}
+	s := NewServer(Chain(func(ctx *Context) {}, a.Middleware), 0)
+	tests := []struct {
+		realm string
+		want  string
+	}{
+		{"one", `Basic realm="one", charset="UTF-8"`},
+		{"one", `Basic realm="one", charset="UTF-8"`},
+		{`two "2"`, `Basic realm="two \"2\"", charset="UTF-8"`},
+		{"", `Basic realm="", charset="UTF-8"`},
+	}
+	for i, tt := range tests {
+		a.Realm = tt.realm
+		out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+		resp := readResponses(t, out, "GET")[0]
+		if v := resp.Header.Get(HeaderWWWAuthenticate); resp.StatusCode != StatusUnauthorized || v != tt.want {
+			t.Errorf("request %d: %d challenge %q, want %q", i, resp.StatusCode, v, tt.want)
+		}
+	}
+}
+
+// digestAuthorization answers a challenge for nonce the way a client does
+func digestAuthorization(user, password, realm, method, uri, nonce, nc, alg string) string {
+	var h = sha256.New()
+	if alg == "" || alg == "MD5" {
+		h = (&DigestAuth{Algorithms: []string{"MD5"}}).hashFunc("MD5")()
+	}
+	ha1 := digestHex(h, []byte(user), []byte(realm), []byte(password))
+	ha2 := digestHex(h, []byte(method), []byte(uri))
+	r := digestHex(h, ha1, []byte(nonce), []byte(nc), []byte("abc"), byteQopAuth, ha2)
+	v := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="abc", response="%s"`,
+		user, realm, nonce, uri, nc, r)
+	if alg != "" {
+		v += ", algorithm=" + alg
+	}
+	return v
+}
+
+func TestDigestAuth(t *testing.T) {
+	a := NewDigestAuth("adm", testCredentials)
+	s := NewServer(Chain(func(ctx *Context) { ctx.Response().SetBody([]byte("hi " + ctx.AuthUser())) }, a.Middleware), 0)
+	now := time.Now()
+	n1, n2 := a.nonce(now), a.nonce(now.Add(time.Millisecond))
+	forged := NewDigestAuth("adm", testCredentials).nonce(now)
+	expired := a.nonce(now.Add(-time.Hour))
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+		stale  bool
+	}{
+		{"sha-256", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", n1, "00000001", "SHA-256"), StatusOK, false},
+		{"replayed nc", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", n1, "00000001", "SHA-256"), StatusUnauthorized, false},
+		{"next nc", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", n1, "00000002", "MD5"), StatusOK, false},
+		{"lower nc", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", n1, "00000001", "MD5"), StatusUnauthorized, false},
+		{"md5 by default", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", n2, "00000001", ""), StatusOK, false},
+		{"invalid nc", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", n2, "2", ""), StatusUnauthorized, false},
+		{"wrong password", digestAuthorization("bob", "nope", "adm", "GET", "/x?y", n2, "00000005", ""), StatusUnauthorized, false},
+		{"unknown user", digestAuthorization("eve", "secret", "adm", "GET", "/x?y", n2, "00000006", ""), StatusUnauthorized, false},
+		{"other uri", digestAuthorization("bob", "secret", "adm", "GET", "/other", n2, "00000007", ""), StatusUnauthorized, false},
+		{"other realm", digestAuthorization("bob", "secret", "x", "GET", "/x?y", n2, "00000008", ""), StatusUnauthorized, false},
+		{"forged nonce", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", forged, "00000001", ""), StatusUnauthorized, false},
+		{"expired nonce", digestAuthorization("bob", "secret", "adm", "GET", "/x?y", expired, "00000001", ""), StatusUnauthorized, true},
+		{"missing", "", StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		header := ""
+		if tt.auth != "" {
+			header = "Authorization: " + tt.auth + "\r\n"
+		}
+		out, _ := serveString(s, "GET /x?y HTTP/1.1\r\nHost: a\r\n"+header+"\r\n")
+		resp := readResponses(t, out, "GET")[0]
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == StatusOK {
+			if body := readBody(resp); body != "hi bob" {
+				t.Errorf("%s: body %q", tt.name, body)
+			}
+			continue
+		}
+		challenges := resp.Header.Values(HeaderWWWAuthenticate)
+		if len(challenges) != 2 || !strings.Contains(challenges[0], "algorithm=SHA-256") || !strings.Contains(challenges[1], "algorithm=MD5") {
+			t.Errorf("%s: challenges %q", tt.name, challenges)
+		}
+		if stale := strings.HasSuffix(challenges[0], "stale=true"); stale != tt.stale {
+			t.Errorf("%s: stale %v, want %v", tt.name, stale, tt.stale)
+		}
+	}
+
+	//with one nonce kept, handing out another forgets the first
+	a.MaxNonces = 1
+	forgotten := a.nonce(now.Add(2 * time.Millisecond))
+	a.nonce(now.Add(3 * time.Millisecond))
+	out, _ := serveString(s, "GET /x?y HTTP/1.1\r\nHost: a\r\nAuthorization: "+
+		digestAuthorization("bob", "secret", "adm", "GET", "/x?y", forgotten, "00000001", "")+"\r\n\r\n")
+	resp := readResponses(t, out, "GET")[0]
+	if resp.StatusCode != StatusUnauthorized || !strings.HasSuffix(resp.Header.Get(HeaderWWWAuthenticate), "stale=true") {
+		t.Errorf("forgotten nonce: status %d %q", resp.StatusCode, resp.Header.Get(HeaderWWWAuthenticate))
+	}
+}
+
+func TestDigestAuthZeroValue(t *testing.T) {
+	a := &DigestAuth{Store: testCredentials}
+	s := NewServer(Chain(func(ctx *Context) {}, a.Middleware), 0)
+
+	//a nonce made with an empty key must not be accepted
+	var raw [nonceSize]byte
+	binary.BigEndian.PutUint64(raw[:8], uint64(time.Now().UnixNano()))
+	m := hmac.New(sha256.New, nil)
+	m.Write(raw[:8])
+	copy(raw[8:], m.Sum(nil))
+	forged := base64.RawURLEncoding.EncodeToString(raw[:])
+	out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\nAuthorization: "+
+		digestAuthorization("bob", "secret", "", "GET", "/", forged, "00000001", "")+"\r\n\r\n")
+	resp := readResponses(t, out, "GET")[0]
+	if resp.StatusCode != StatusUnauthorized || len(a.secret) == 0 {
+		t.Fatalf("nonce forged with an empty secret: status %d", resp.StatusCode)
+	}
+
+	challenges := resp.Header.Values(HeaderWWWAuthenticate)
+	if len(challenges) != 2 {
+		t.Fatalf("challenges %q", challenges)
+	}
+	nonce := strings.SplitN(strings.SplitN(challenges[1], `nonce="`, 2)[1], `"`, 2)[0]
+	out, _ = serveString(s, "GET / HTTP/1.1\r\nHost: a\r\nAuthorization: "+
+		digestAuthorization("bob", "secret", "", "GET", "/", nonce, "00000001", "MD5")+"\r\n\r\n")
+	if resp := readResponses(t, out, "GET")[0]; resp.StatusCode != http.StatusOK {
+		t.Errorf("answer to the challenge: status %d", resp.StatusCode)
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	got := map[string]string{}
+	parseAuthParams([]byte(` a=1, b="x, \"y\"",c = "z" ,, d=`), func(k, v []byte) { got[string(k)] = string(v) })
+	want := map[string]string{"a": "1", "b": `x, \"y\"`, "c": "z", "d": ""}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("params %q, want %q", got, want)
+	}
+	got = map[string]string{}
+	parseAuthParams([]byte(`a="unterminated`), func(k, v []byte) { got[string(k)] = string(v) })
+	if len(got) != 0 {
+		t.Errorf("unterminated quote gave %q", got)
+	}
+}
@@ -11,14 +11,18 @@ var (
 	byteSlashDotSlash    = []byte("/./")
 	byteSlashDotDotSlash = []byte("/../")
 	byteCRLF             = []byte("\r\n")
+	byteLF               = []byte("\n")
 	byteHTTP             = []byte("http")
 	byteHTTPS            = []byte("https")
 	byteHTTP11           = []byte("HTTP/1.1")
 	byteColon            = []byte(":")
 	byteColonSlashSlash  = []byte("://")
 	byteColonSpace       = []byte(": ")
+	byteCommaSpace       = []byte(", ")
+	byteHTTPSlash        = []byte("HTTP/")
 	byteGMT              = []byte("GMT")
 	byteAt               = []byte("@")
+	byteAsterisk         = []byte("*")
 
 	byteResponseContinue = []byte("HTTP/1.1 100 Continue\r\n\r\n")
 
@@ -53,6 +57,10 @@ var (
 	byteRange            = []byte(HeaderRange)
 	byteContentRange     = []byte(HeaderContentRange)
 	byteAuthorization    = []byte(HeaderAuthorization)
+	byteVia              = []byte(HeaderVia)
+	byteXForwardedFor    = []byte(HeaderXForwardedFor)
+	byteXForwardedHost   = []byte(HeaderXForwardedHost)
+	byteXForwardedProto  = []byte(HeaderXForwardedProto)
 
 	byteCookieExpires         = []byte("expires")
 	byteCookieDomain          = []byte("domain")
@@ -71,6 +79,7 @@ var (
 	byteKeepAlive           = []byte("keep-alive")
 	byteUpgrade             = []byte("Upgrade")
 	byteChunked             = []byte("chunked")
+	byteLastChunk           = []byte("0\r\n\r\n")
 	byteIdentity            = []byte("identity")
 	byte100Continue         = []byte("100-continue")
 	bytePostArgsContentType = []byte("application/x-www-form-urlencoded")
@@ -2,8 +2,12 @@ package http1
 
 import (
 	"bufio"
+	"context"
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -16,39 +20,118 @@ type Context struct {
 	resp            *Response
 	connRequestNum  uint64
 	writer          *bufio.Writer
+	head            bool //the request method is HEAD, even if Handler sees GET
+	pipelined       int  //requests answered back to back from buffered data
+	hijack          HijackHandler
+	hijackNoResp    bool //the hijack handler answers the request itself
+	client          clientInfo
+	authUser        string
+	start           time.Time //first data of the current request
+	headerParsed    time.Time
+	span            *Span
+	respStarted     bool //the response is being written, a panic can't replace it
+	reqCtx          context.Context
+	cancel          context.CancelFunc
+	userValues      []userValue
+	bodyRead        time.Time
+	timing          ServerTiming
+}
+
+// HijackHandler takes over a connection once the response to the hijacking request is sent
+type HijackHandler interface {
+	//Serve is called right after the response is flushed and again whenever data arrives,
+	//it shifts what it consumed from c. An error closes the connection
+	Serve(c Conn) error
+	//Close is called when the context is released or reset
+	Close() error
 }
 
 func NewContext(s *Server, conn Conn) *Context {
-	return &Context{
+	ctx := &Context{
 		s:      s,
 		conn:   conn,
 		req:    NewRequst(conn.RemoteAddr().String()),
 		resp:   NewResponse(),
 		writer: bufio.NewWriterSize(conn, 4096),
 	}
+	ctx.req.SetLimits(s.Limits)
+	return ctx
 }
 
 func (ctx *Context) Reset(conn Conn) {
+	ctx.closeHijack()
 	ctx.conn = conn
+	ctx.req.SetLimits(ctx.s.Limits)
 	ctx.resp.Reset()
 	ctx.req.Reset()
 	ctx.connRequestNum = 0
+	ctx.pipelined = 0
 	ctx.continueReqSend = false
+	ctx.head = false
+	ctx.client.reset()
+	ctx.client.peer = nil
+	ctx.authUser = ""
+	ctx.start = time.Time{}
+	ctx.headerParsed = time.Time{}
+	ctx.bodyRead = time.Time{}
+	ctx.timing.reset()
+	ctx.span = nil
+	ctx.respStarted = false
+	ctx.cancelRequest()
+	ctx.resetUserValues()
 	ctx.writer.Reset(conn)
 }
 
-//CleanHttpTransation 擦除request和response的信息，
+// CleanHttpTransation 擦除request和response的信息，
+// pipelined responses may still wait in the writer, so it is not reset
 func (ctx *Context) CleanHttpTransation(conn Conn) {
 	ctx.resp.Reset()
 	ctx.req.Reset()
-	ctx.writer.Reset(conn)
 	ctx.continueReqSend = false
+	ctx.head = false
+	ctx.client.reset()
+	ctx.authUser = ""
+	ctx.start = time.Time{}
+	ctx.headerParsed = time.Time{}
+	ctx.bodyRead = time.Time{}
+	ctx.timing.reset()
+	ctx.span = nil
+	ctx.respStarted = false
+	ctx.cancelRequest()
+	ctx.resetUserValues()
+}
+
+// Hijack hands the connection to h after the response is sent, the response
+// goes out without body framing and HTTP is no longer parsed on the connection
+func (ctx *Context) Hijack(h HijackHandler) {
+	ctx.hijack = h
+	ctx.resp.header.hijacked = true
+}
+
+// HijackSetNoResponse leaves the response to the hijacking request to the
+// HijackHandler, which writes it to the connection itself
+func (ctx *Context) HijackSetNoResponse(noResponse bool) {
+	ctx.hijackNoResp = noResponse
+}
+
+func (ctx *Context) closeHijack() {
+	if ctx.hijack != nil {
+		ctx.hijack.Close()
+		ctx.hijack = nil
+	}
+	ctx.hijackNoResp = false
 }
 
 func (ctx *Context) RemoteAddr() net.Addr {
 	return ctx.conn.RemoteAddr()
 }
 
+// IsHead reports whether the client sent a HEAD request.
+// It stays true when Server.HeadAsGet rewrites the method to GET.
+func (ctx *Context) IsHead() bool {
+	return ctx.head
+}
+
 func (ctx *Context) Request() *Request {
 	return ctx.req
 }
@@ -57,54 +140,259 @@ func (ctx *Context) Response() *Response {
 	return ctx.resp
 }
 
-func (ctx *Context) ServeHttp() error {
+var errShouldClose = errors.New("should  close")
+
+// ServeHttp serves the data buffered on the connection. A panic in the handler is
+// logged and answered with 500 unless the response was already started, the
+// returned error closes the connection
+func (ctx *Context) ServeHttp() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = ctx.recoverPanic(v)
+		}
+		if err != nil {
+			ctx.cancelRequest()
+		}
+	}()
+	return ctx.serveHttp()
+}
+
+func (ctx *Context) serveHttp() error {
+	if ctx.hijack != nil {
+		ctx.respStarted = true
+		return ctx.hijack.Serve(ctx.conn)
+	}
+	if ctx.start.IsZero() {
+		ctx.start = time.Now()
+	}
 	if !ctx.req.parseHeaderComplete {
-		if err := ctx.req.parse(ctx.conn); err != nil {
-			if err == StatusPartial {
-				return nil
-			}
-			return err
+		if err := ctx.req.parseHeader(ctx.conn); err != nil {
+			return ctx.parseFailed(err)
+		}
+		ctx.headerParsed = time.Now()
+		if ctx.s.HeaderHandler != nil && !ctx.s.HeaderHandler(ctx) {
+			return ctx.closeWithResponse()
+		}
+		if !ctx.checkExpect() {
+			return ctx.closeWithResponse()
 		}
 	}
-	//100 continue
-	if ctx.req.IsContinue() && !ctx.continueReqSend {
-		ctx.writer.Write(byteResponseContinue)
-		ctx.writer.Flush()
-		ctx.continueReqSend = true
-		return nil
+	if err := ctx.req.ContinueReadBody(ctx.conn); err != nil {
+		return ctx.parseFailed(err)
+	}
+	ctx.bodyRead = time.Now()
+
+	if ctx.req.IsHead() {
+		ctx.head = true
+		if ctx.s.HeadAsGet {
+			ctx.req.header.Method = byteGet
+		}
 	}
+	ctx.resp.SkipBody(ctx.head)
 
+	handlerStart := time.Now()
 	ctx.s.Handler(ctx)
-	ctx.resp.Write(ctx.writer)
-	if ctx.conn.Buffered() == 0 || ctx.req.ShouldClose() {
+	ctx.respStarted = true
+	if ctx.hijack != nil {
+		if !ctx.hijackNoResp {
+			ctx.resp.Write(ctx.writer)
+		}
+		err := ctx.writer.Flush()
+		ctx.finish()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return ctx.hijack.Serve(ctx.conn)
+	}
+
+	ctx.connRequestNum++
+	if ctx.conn.Buffered() > 0 {
+		ctx.pipelined++
+	} else {
+		ctx.pipelined = 0
+	}
+	if ctx.req.ShouldClose() ||
+		(ctx.s.MaxServeTimesPerConn > 0 && ctx.connRequestNum >= ctx.s.MaxServeTimesPerConn) ||
+		(ctx.s.Limits.MaxPipelinedRequests > 0 && ctx.pipelined >= ctx.s.Limits.MaxPipelinedRequests) {
+		ctx.resp.SetClose(true)
+	}
+	if ctx.s.ServerTiming {
+		ctx.addServerTiming(handlerStart, time.Now())
+	}
+	if err := ctx.resp.Write(ctx.writer); err != nil {
+		//a streamed body failed half way, the framing can't be completed
+		ctx.writer.Flush()
+		ctx.finish()
+		return err
+	}
+	shouldClose := ctx.resp.header.Close
+	if ctx.conn.Buffered() == 0 || shouldClose {
 		err := ctx.writer.Flush()
 		//fmt.Println(ctx.writer.Buffered())
 		if err != nil {
 			//	ReleaseContext(ctx)
+			ctx.finish()
 			return errors.WithStack(err)
 		}
 	}
-	if ctx.req.ShouldClose() || (ctx.s.MaxServeTimesPerConn > 0 && ctx.s.MaxServeTimesPerConn > ctx.connRequestNum) {
+	ctx.finish()
+	if shouldClose {
 		//ReleaseContext(ctx)
-		return errors.New("should  close")
+		return errShouldClose
 	}
-	ctx.connRequestNum++
 	ctx.CleanHttpTransation(ctx.conn)
 	return nil
 }
 
+// checkExpect answers the Expect header before the body is read.
+// It returns false when a final response was prepared instead of 100 Continue
+func (ctx *Context) checkExpect() bool {
+	expect := ctx.req.header.GetHeader(HeaderExpect)
+	if len(expect) == 0 {
+		return true
+	}
+	if !ctx.req.IsContinue() {
+		ctx.resp.SetStatusCode(StatusExpectationFailed)
+		return false
+	}
+	//HTTP/1.0 clients don't wait for 100 Continue, a request without body needs none
+	if !ctx.req.header.HTTP11 || ctx.req.header.ContentLength == 0 {
+		return true
+	}
+	if ctx.s.ContinueHandler != nil && !ctx.s.ContinueHandler(ctx) {
+		if ctx.s.Metrics != nil {
+			atomic.AddUint64(&ctx.s.Metrics.continueRefused, 1)
+		}
+		if ctx.resp.header.StatusCode <= 0 || ctx.resp.header.StatusCode == StatusOK {
+			ctx.resp.SetStatusCode(StatusExpectationFailed)
+		}
+		return false
+	}
+	if ctx.s.Metrics != nil {
+		atomic.AddUint64(&ctx.s.Metrics.continueSent, 1)
+	}
+	ctx.writer.Write(byteResponseContinue)
+	ctx.writer.Flush()
+	ctx.continueReqSend = true
+	return true
+}
+
+// parseFailed waits for more data on StatusPartial, a ParseError is answered
+// with its status before the connection is closed
+func (ctx *Context) parseFailed(err error) error {
+	if err == StatusPartial {
+		return nil
+	}
+	pe, ok := err.(*ParseError)
+	if !ok {
+		return err
+	}
+	if ctx.s.Metrics != nil {
+		ctx.s.Metrics.parseError(pe.Err)
+	}
+	ctx.resp.SetStatusCode(pe.Status)
+	if ctx.s.ErrorHandler != nil {
+		ctx.s.ErrorHandler(ctx, pe)
+	} else {
+		ctx.resp.SetBody(s2b(reason(pe.Status)))
+	}
+	if cerr := ctx.closeWithResponse(); cerr != errShouldClose {
+		return cerr
+	}
+	return err
+}
+
+// closeWithResponse sends the prepared response with 'Connection: close',
+// the request body is left unread so the connection can't be reused
+func (ctx *Context) closeWithResponse() error {
+	ctx.req.needClose()
+	ctx.connRequestNum++
+	ctx.resp.SetClose(true)
+	ctx.respStarted = true
+	ctx.resp.Write(ctx.writer)
+	err := ctx.writer.Flush()
+	ctx.finish()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errShouldClose
+}
+
+// recoverPanic logs v with its stack and sends a 500 with 'Connection: close' if the
+// response wasn't started, the request and response buffers go back to their pools
+func (ctx *Context) recoverPanic(v interface{}) error {
+	ctx.s.logf("http1: panic serving %v: %v\n%s", ctx.RemoteAddr(), v, debug.Stack())
+	if ctx.respStarted {
+		//what was written is sent, the connection is closed before a partial response is reused
+		ctx.writer.Flush()
+	} else {
+		ctx.closeHijack()
+		ctx.resp.Reset()
+		ctx.resp.SetStatusCode(StatusInternalServerError)
+		ctx.resp.SkipBody(ctx.head)
+		if ctx.s.PanicHandler == nil || !ctx.callPanicHandler(v) {
+			ctx.resp.SetBody(s2b(reason(StatusInternalServerError)))
+		}
+		ctx.closeWithResponse()
+	}
+	ctx.req.BodyRelease()
+	ctx.resp.BodyRelease()
+	return errors.Errorf("http1: handler panic: %v", v)
+}
+
+// callPanicHandler returns false if PanicHandler panicked too, the response is reset to 500
+func (ctx *Context) callPanicHandler(v interface{}) (ok bool) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			ctx.s.logf("http1: panic in PanicHandler: %v", pv)
+			ctx.resp.Reset()
+			ctx.resp.SetStatusCode(StatusInternalServerError)
+			ctx.resp.SkipBody(ctx.head)
+		}
+	}()
+	ctx.s.PanicHandler(ctx, v)
+	return true
+}
+
+// finish records the transaction whose response was just written and flushed,
+// pipelined responses may still wait in the writer
+func (ctx *Context) finish() {
+	if ctx.s.AccessLog != nil {
+		ctx.logAccess()
+	}
+	if ctx.s.Metrics != nil {
+		ctx.s.Metrics.observe(ctx)
+	}
+	if ctx.span != nil {
+		ctx.endSpan()
+	}
+}
+
 var contextPool sync.Pool
 
 func AcquireContext(s *Server, conn Conn) *Context {
+	if s.Metrics != nil {
+		s.Metrics.connOpened()
+	}
 	v := contextPool.Get()
 	if v == nil {
+		atomic.AddUint64(&contextPoolMisses, 1)
 		return NewContext(s, conn)
 	}
+	atomic.AddUint64(&contextPoolHits, 1)
 	r := v.(*Context)
+	r.s = s
 	r.Reset(conn)
 	return r
 }
 
 func ReleaseContext(ctx *Context) {
+	ctx.cancelRequest()
+	ctx.resetUserValues()
+	ctx.req.closeSink()
+	if ctx.s.Metrics != nil {
+		ctx.s.Metrics.connClosed()
+	}
+	ctx.closeHijack()
 	contextPool.Put(ctx)
 }
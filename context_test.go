@@ -0,0 +1,331 @@
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testConn is a Conn fed from a string, what the server writes is kept in out
+type testConn struct {
+	mu     sync.Mutex
+	in     []byte
+	out    bytes.Buffer
+	closed bool
+	addr   net.Addr
+}
+
+func newTestConn(raw string) *testConn {
+	return &testConn{in: []byte(raw), addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}}
+}
+
+func (c *testConn) Bytes() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.in, nil
+}
+
+func (c *testConn) Shift(n int) {
+	c.mu.Lock()
+	c.in = c.in[n:]
+	c.mu.Unlock()
+}
+
+func (c *testConn) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.in)
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *testConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *testConn) feed(s string) {
+	c.mu.Lock()
+	c.in = append(c.in, s...)
+	c.mu.Unlock()
+}
+
+func (c *testConn) output() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.String()
+}
+
+func (c *testConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// serveConn runs ctx over the buffered data until it is consumed or an error closes the connection
+func serveConn(ctx *Context, c *testConn) error {
+	var err error
+	for c.Buffered() > 0 {
+		before := c.Buffered()
+		if err = ctx.ServeHttp(); err != nil || c.Buffered() == before {
+			break
+		}
+	}
+	ctx.writer.Flush()
+	return err
+}
+
+// serveString serves raw on a fresh connection and returns what was written
+func serveString(s *Server, raw string) (string, error) {
+	c := newTestConn(raw)
+	ctx := AcquireContext(s, c)
+	err := serveConn(ctx, c)
+	ReleaseContext(ctx)
+	return c.output(), err
+}
+
+// readResponses parses the responses in out, method tells how to frame each of them
+func readResponses(t *testing.T, out string, methods ...string) []*http.Response {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(out))
+	var resps []*http.Response
+	for _, m := range methods {
+		resp, err := http.ReadResponse(br, &http.Request{Method: m})
+		if err != nil {
+			t.Fatalf("reading response to %s: %v in %q", m, err, out)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v in %q", err, out)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resps = append(resps, resp)
+	}
+	if rest, _ := ioutil.ReadAll(br); len(rest) > 0 {
+		t.Fatalf("unexpected data after the responses: %q", rest)
+	}
+	return resps
+}
+
+func readBody(resp *http.Response) string {
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestHeadSuppressesBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		headAsGet bool
+		handler   HandlerFunc
+		length    string
+		chunked   bool
+	}{
+		{"body", false, func(ctx *Context) { ctx.Response().SetBody([]byte("hello")) }, "5", false},
+		{"head as get", true, func(ctx *Context) {
+			if ctx.Request().IsGet() && ctx.IsHead() {
+				ctx.Response().SetBody([]byte("hello"))
+			}
+		}, "5", false},
+		{"file", false, func(ctx *Context) { ctx.Response().SendFile("go.mod") }, "", false},
+		{"sized stream", false, func(ctx *Context) {
+			ctx.Response().SetBodyStream(strings.NewReader("abc"), 3)
+		}, "3", false},
+		{"unsized stream", false, func(ctx *Context) {
+			ctx.Response().SetBodyStream(strings.NewReader("abc"), -1)
+		}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(tt.handler, 0)
+			s.HeadAsGet = tt.headAsGet
+			get, err := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, err := serveString(s, "HEAD / HTTP/1.1\r\nHost: a\r\n\r\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			g := readResponses(t, get, "GET")[0]
+			h := readResponses(t, head, "HEAD")[0]
+			if h.StatusCode != StatusOK {
+				t.Fatalf("status %d", h.StatusCode)
+			}
+			length := tt.length
+			if length == "" && !tt.chunked {
+				length = g.Header.Get(HeaderContentLength)
+			}
+			if got := h.Header.Get(HeaderContentLength); got != length {
+				t.Errorf("HEAD Content-Length %q, want %q", got, length)
+			}
+			if tt.chunked != strings.Contains(head, "Transfer-Encoding: chunked") {
+				t.Errorf("HEAD chunked framing mismatch in %q", head)
+			}
+			if g.Header.Get(HeaderContentType) != h.Header.Get(HeaderContentType) {
+				t.Errorf("Content-Type differs: %q and %q", g.Header.Get(HeaderContentType), h.Header.Get(HeaderContentType))
+			}
+			if !strings.HasSuffix(head, "\r\n\r\n") {
+				t.Errorf("HEAD response carries a body: %q", head)
+			}
+		})
+	}
+}
+
+func TestHeadKeepAlive(t *testing.T) {
+	s := NewServer(func(ctx *Context) { ctx.Response().SetBody([]byte("hello")) }, 0)
+	out, err := serveString(s, "HEAD / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resps := readResponses(t, out, "HEAD", "GET")
+	if body := readBody(resps[1]); body != "hello" {
+		t.Errorf("GET after HEAD body %q", body)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := NewServer(func(ctx *Context) {
+		ctx.Response().SetBody(append([]byte("got:"), ctx.Request().Body()...))
+	}, 0)
+	s.ContinueHandler = func(ctx *Context) bool {
+		if ctx.Request().Header().ContentLength > 10 {
+			ctx.Response().SetStatusCode(StatusRequestEntityTooLarge)
+			return false
+		}
+		if len(ctx.Request().Header().GetHeader(HeaderAuthorization)) == 0 {
+			return false
+		}
+		return true
+	}
+	tests := []struct {
+		name        string
+		raw         string
+		continue100 bool
+		status      int
+		body        string
+		closed      bool
+	}{
+		{"accepted", "POST / HTTP/1.1\r\nAuthorization: x\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\nabc", true, 200, "got:abc", false},
+		{"too large", "POST / HTTP/1.1\r\nAuthorization: x\r\nExpect: 100-continue\r\nContent-Length: 30\r\n\r\n", false, 413, "", true},
+		{"default 417", "POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\n", false, 417, "", true},
+		{"unknown expectation", "POST / HTTP/1.1\r\nExpect: foo\r\nContent-Length: 3\r\n\r\nabc", false, 417, "", true},
+		{"http/1.0 gets no 100", "POST / HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\nabc", false, 200, "got:abc", true},
+		{"no body", "POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 0\r\n\r\n", false, 200, "got:", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := serveString(s, tt.raw)
+			if got := strings.HasPrefix(out, string(byteResponseContinue)); got != tt.continue100 {
+				t.Fatalf("100 Continue sent %v, want %v: %q", got, tt.continue100, out)
+			}
+			out = strings.TrimPrefix(out, string(byteResponseContinue))
+			resp := readResponses(t, out, "POST")[0]
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" {
+				if body := readBody(resp); body != tt.body {
+					t.Errorf("body %q, want %q", body, tt.body)
+				}
+			}
+			if resp.Close != tt.closed {
+				t.Errorf("close %v, want %v", resp.Close, tt.closed)
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	panicking := func(ctx *Context) {
+		ctx.Response().SetBody([]byte("partial"))
+		ctx.Response().Header().Set("X-A", []byte("1"))
+		panic("boom")
+	}
+	tests := []struct {
+		name         string
+		handler      HandlerFunc
+		panicHandler func(ctx *Context, v interface{})
+		method       string
+		status       int
+		body         string
+		log          string
+	}{
+		{"default", panicking, nil, "GET", StatusInternalServerError, "Internal Server Error", "panic serving"},
+		{"head", panicking, nil, "HEAD", StatusInternalServerError, "", "panic serving"},
+		{"panic handler", panicking, func(ctx *Context, v interface{}) {
+			ctx.JSON(StatusServiceUnavailable, map[string]string{"panic": fmt.Sprint(v)})
+		}, "GET", StatusServiceUnavailable, `{"panic":"boom"}` + "\n", "panic serving"},
+		{"panic handler keeps 500", panicking, func(ctx *Context, v interface{}) {
+			ctx.Response().SetBody([]byte("oops"))
+		}, "GET", StatusInternalServerError, "oops", "panic serving"},
+		{"panicking panic handler", panicking, func(ctx *Context, v interface{}) {
+			ctx.Response().SetBody([]byte("half"))
+			panic("again")
+		}, "GET", StatusInternalServerError, "Internal Server Error", "panic in PanicHandler: again"},
+		{"error value", func(ctx *Context) { panic(fmt.Errorf("err")) }, nil, "GET", StatusInternalServerError, "Internal Server Error", "err"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s := NewServer(tt.handler, 0)
+			s.PanicHandler = tt.panicHandler
+			s.ErrorLog = log.New(&logs, "", 0)
+			//the request pipelined after the panic is not served
+			out, err := serveString(s, tt.method+" / HTTP/1.1\r\nHost: a\r\n\r\nGET /next HTTP/1.1\r\nHost: a\r\n\r\n")
+			if err == nil {
+				t.Error("connection left open after a panic")
+			}
+			resp := readResponses(t, out, tt.method)[0]
+			if resp.StatusCode != tt.status || !resp.Close || resp.Header.Get("X-A") != "" {
+				t.Errorf("status %d close %v headers %v", resp.StatusCode, resp.Close, resp.Header)
+			}
+			if body := readBody(resp); body != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+			if !strings.Contains(logs.String(), tt.log) {
+				t.Errorf("log %q, want %q", logs.String(), tt.log)
+			}
+		})
+	}
+}
+
+func TestPanicAfterResponseStarted(t *testing.T) {
+	var logs bytes.Buffer
+	s := NewServer(func(ctx *Context) {
+		ctx.NDJSON(StatusOK, func(w *NDJSONWriter) error {
+			w.Encode(1)
+			w.Flush()
+			panic("mid stream")
+		})
+	}, 0)
+	s.ErrorLog = log.New(&logs, "", 0)
+	c := newTestConn("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	ctx := AcquireContext(s, c)
+	err := serveConn(ctx, c)
+	ReleaseContext(ctx)
+	out := c.output()
+	if err == nil || !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || strings.Contains(out, "500") {
+		t.Errorf("err %v output %q", err, out)
+	}
+	if !strings.HasSuffix(out, "1\n\r\n") {
+		t.Errorf("written lines not flushed: %q", out)
+	}
+	if !strings.Contains(logs.String(), "mid stream") {
+		t.Errorf("log %q", logs.String())
+	}
+}
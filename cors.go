@@ -0,0 +1,197 @@
+package http1
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	byteTrue           = []byte("true")
+	defaultCORSMethods = []string{MethodGet, MethodHead, MethodPost}
+)
+
+// CORSConfig describes the cross-origin requests CORS allows
+type CORSConfig struct {
+	//AllowOrigins lists exact origins such as "https://example.com", "*" for any origin
+	//or a wildcard subdomain such as "https://*.example.com"
+	AllowOrigins []string
+	//AllowOriginFunc is asked about origins AllowOrigins doesn't match
+	AllowOriginFunc func(origin []byte) bool
+	//AllowMethods defaults to GET, HEAD and POST
+	AllowMethods []string
+	//AllowHeaders lists the request headers a preflight may ask for,
+	//when empty the requested headers are allowed
+	AllowHeaders []string
+	//AllowCredentials is not sent with "*", browsers refuse credentials for any origin
+	AllowCredentials bool
+	ExposeHeaders    []string
+	//MaxAge is how long a preflight result may be cached, 0 leaves it to the client
+	MaxAge time.Duration
+}
+
+type cors struct {
+	any         bool
+	exact       []string
+	wildcards   [][2]string //scheme://*. and the domain suffix
+	originFunc  func(origin []byte) bool
+	methods     []string
+	headers     []string
+	credentials bool
+
+	allowMethods  []byte
+	allowHeaders  []byte
+	exposeHeaders []byte
+	maxAge        []byte
+}
+
+// CORS answers preflight requests with 204 without calling the handler and adds
+// the Access-Control headers to the responses of allowed origins
+func CORS(c CORSConfig) Middleware {
+	h := &cors{
+		originFunc:  c.AllowOriginFunc,
+		methods:     c.AllowMethods,
+		headers:     c.AllowHeaders,
+		credentials: c.AllowCredentials,
+	}
+	for _, o := range c.AllowOrigins {
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		switch {
+		case o == "*":
+			h.any = true
+		case strings.Contains(o, "://*."):
+			i := strings.Index(o, "*.")
+			h.wildcards = append(h.wildcards, [2]string{o[:i], o[i+1:]})
+		default:
+			h.exact = append(h.exact, o)
+		}
+	}
+	if len(h.methods) == 0 {
+		h.methods = defaultCORSMethods
+	}
+	h.allowMethods = []byte(strings.Join(h.methods, ", "))
+	if len(h.headers) > 0 {
+		h.allowHeaders = []byte(strings.Join(h.headers, ", "))
+	}
+	if len(c.ExposeHeaders) > 0 {
+		h.exposeHeaders = []byte(strings.Join(c.ExposeHeaders, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.maxAge = []byte(strconv.Itoa(int(c.MaxAge / time.Second)))
+	}
+	return h.middleware
+}
+
+func (h *cors) middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		origin := ctx.req.header.GetHeader(HeaderOrigin)
+		resp := &ctx.resp.header
+		if !h.any {
+			//the answer depends on Origin even when it is missing or refused
+			resp.AddVary(HeaderOrigin)
+		}
+		if bytes.Equal(ctx.req.header.Method, byteOptions) && len(origin) > 0 &&
+			len(ctx.req.header.GetHeader(HeaderAccessControlRequestMethod)) > 0 {
+			h.preflight(ctx, origin)
+			return
+		}
+		if len(origin) > 0 && h.allowOrigin(origin) {
+			h.setOrigin(resp, origin)
+			if len(h.exposeHeaders) > 0 {
+				resp.Set(HeaderAccessControlExposeHeaders, h.exposeHeaders)
+			}
+		}
+		next(ctx)
+	}
+}
+
+func (h *cors) preflight(ctx *Context, origin []byte) {
+	resp := &ctx.resp.header
+	resp.AddVary(HeaderAccessControlRequestMethod)
+	resp.AddVary(HeaderAccessControlRequestHeaders)
+	ctx.resp.SetStatusCode(StatusNoContent)
+	ctx.resp.SetContentType(nil)
+	if !h.allowOrigin(origin) {
+		return
+	}
+	method := ctx.req.header.GetHeader(HeaderAccessControlRequestMethod)
+	if !h.allowMethod(method) {
+		return
+	}
+	requested := ctx.req.header.GetHeader(HeaderAccessControlRequestHeaders)
+	if !h.allowRequestHeaders(requested) {
+		return
+	}
+	h.setOrigin(resp, origin)
+	resp.Set(HeaderAccessControlAllowMethods, h.allowMethods)
+	if len(h.allowHeaders) > 0 {
+		resp.Set(HeaderAccessControlAllowHeaders, h.allowHeaders)
+	} else if len(requested) > 0 {
+		resp.Set(HeaderAccessControlAllowHeaders, requested)
+	}
+	if len(h.maxAge) > 0 {
+		resp.Set(HeaderAccessControlMaxAge, h.maxAge)
+	}
+}
+
+func (h *cors) setOrigin(resp *ResponseHeader, origin []byte) {
+	if h.any {
+		//echoing the origin with credentials would hand them to any site, "null" included
+		resp.Set(HeaderAccessControlAllowOrigin, byteAsterisk)
+		return
+	}
+	resp.Set(HeaderAccessControlAllowOrigin, origin)
+	if h.credentials {
+		resp.Set(HeaderAccessControlAllowCredentials, byteTrue)
+	}
+}
+
+func (h *cors) allowOrigin(origin []byte) bool {
+	if h.any {
+		return true
+	}
+	o := b2s(origin)
+	for _, e := range h.exact {
+		if equalFoldString(o, e) {
+			return true
+		}
+	}
+	for _, w := range h.wildcards {
+		scheme, suffix := w[0], w[1]
+		//the subdomain must not be empty, "https://.example.com" isn't allowed
+		if len(o) > len(scheme)+len(suffix) &&
+			equalFoldString(o[:len(scheme)], scheme) &&
+			equalFoldString(o[len(o)-len(suffix):], suffix) {
+			return true
+		}
+	}
+	return h.originFunc != nil && h.originFunc(origin)
+}
+
+func (h *cors) allowMethod(method []byte) bool {
+	for _, m := range h.methods {
+		if equalFoldString(m, b2s(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *cors) allowRequestHeaders(requested []byte) bool {
+	if len(h.headers) == 0 {
+		return true
+	}
+	ok := true
+	eachListItem(requested, func(name []byte) bool {
+		ok = false
+		for _, a := range h.headers {
+			if equalFoldString(a, b2s(name)) {
+				ok = true
+				break
+			}
+		}
+		return ok
+	})
+	return ok
+}
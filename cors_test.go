@@ -0,0 +1,121 @@
+package http1
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	strict := CORSConfig{
+		AllowOrigins:     []string{"https://a.com/", "https://*.b.com"},
+		AllowOriginFunc:  func(origin []byte) bool { return string(origin) == "https://func.com" },
+		AllowMethods:     []string{MethodGet, MethodPut},
+		AllowHeaders:     []string{"X-Foo"},
+		AllowCredentials: true,
+		ExposeHeaders:    []string{"X-Bar", "X-Baz"},
+		MaxAge:           time.Hour,
+	}
+	anyCreds := CORSConfig{AllowOrigins: []string{"*"}, AllowCredentials: true}
+	preflight := func(origin, method, headers string) string {
+		raw := "OPTIONS /x HTTP/1.1\r\nHost: a\r\nOrigin: " + origin + "\r\nAccess-Control-Request-Method: " + method + "\r\n"
+		if headers != "" {
+			raw += "Access-Control-Request-Headers: " + headers + "\r\n"
+		}
+		return raw + "\r\n"
+	}
+	get := func(origin string) string {
+		return "GET /x HTTP/1.1\r\nHost: a\r\nOrigin: " + origin + "\r\n\r\n"
+	}
+	tests := []struct {
+		name   string
+		config CORSConfig
+		raw    string
+		status int
+		called bool
+		want   map[string]string
+	}{
+		{"preflight", strict, preflight("https://a.com", "PUT", "x-foo"), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "https://a.com", "Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods": "GET, PUT", "Access-Control-Allow-Headers": "X-Foo",
+			"Access-Control-Max-Age": "3600", "Vary": "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+		}},
+		{"preflight wildcard subdomain", strict, preflight("https://x.y.b.com", "GET", ""), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "https://x.y.b.com",
+		}},
+		{"preflight bare domain", strict, preflight("https://b.com", "GET", ""), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"preflight empty subdomain", strict, preflight("https://.b.com", "GET", ""), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"preflight wrong scheme", strict, preflight("http://x.b.com", "GET", ""), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"preflight method", strict, preflight("https://a.com", "DELETE", ""), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": "",
+		}},
+		{"preflight header", strict, preflight("https://a.com", "GET", "X-Foo, X-Other"), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"preflight requested headers echoed", anyCreds, preflight("https://c.com", "POST", "X-Any"), StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Headers": "X-Any",
+		}},
+		{"simple", strict, get("https://A.com"), StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "https://A.com", "Access-Control-Allow-Credentials": "true",
+			"Access-Control-Expose-Headers": "X-Bar, X-Baz", "Vary": "Origin",
+		}},
+		{"origin func", strict, get("https://func.com"), StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "https://func.com",
+		}},
+		{"refused origin", strict, get("https://evil.com"), StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": "", "Vary": "Origin",
+		}},
+		{"null origin", strict, get("null"), StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "", "Vary": "Origin",
+		}},
+		{"no origin", strict, "GET /x HTTP/1.1\r\nHost: a\r\n\r\n", StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "", "Vary": "Origin",
+		}},
+		{"options without request method", strict, "OPTIONS /x HTTP/1.1\r\nHost: a\r\nOrigin: https://a.com\r\n\r\n", StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "https://a.com",
+		}},
+		{"any origin with credentials", anyCreds, get("https://evil.com"), StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": "", "Vary": "",
+		}},
+		{"any origin null", anyCreds, get("null"), StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": "",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			s := NewServer(Chain(func(ctx *Context) {
+				called = true
+				ctx.Response().SetBody([]byte("ok"))
+			}, CORS(tt.config)), 0)
+			out, _ := serveString(s, tt.raw)
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status || called != tt.called {
+				t.Fatalf("status %d called %v, want %d %v", resp.StatusCode, called, tt.status, tt.called)
+			}
+			for k, v := range tt.want {
+				if got := headerValues(resp.Header, k); got != v {
+					t.Errorf("%s: %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+// headerValues joins the values of all k lines as a single list
+func headerValues(h http.Header, k string) string {
+	s := ""
+	for _, v := range h.Values(k) {
+		if s != "" {
+			s += ", "
+		}
+		s += v
+	}
+	return s
+}
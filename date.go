@@ -0,0 +1,55 @@
+package http1
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeFormat is the IMF-fixdate format of RFC 7231, the time must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// obsolete HTTP-date formats a recipient still has to accept
+var httpDateFormats = []string{
+	TimeFormat,
+	time.RFC850,
+	time.ANSIC,
+}
+
+var ErrInvalidHTTPDate = errors.New("invalid http date")
+
+type cachedDate struct {
+	unix int64
+	b    []byte
+}
+
+var serverDate atomic.Value
+
+// currentDate returns the Date header value, it is formatted at most once per second
+// and shared by all connections. The returned slice must not be modified
+func currentDate() []byte {
+	now := time.Now()
+	if d, ok := serverDate.Load().(*cachedDate); ok && d.unix == now.Unix() {
+		return d.b
+	}
+	d := &cachedDate{unix: now.Unix(), b: AppendHTTPDate(nil, now)}
+	serverDate.Store(d)
+	return d.b
+}
+
+// AppendHTTPDate appends t as IMF-fixdate to dst
+func AppendHTTPDate(dst []byte, t time.Time) []byte {
+	dst = t.UTC().AppendFormat(dst, TimeFormat[:len(TimeFormat)-len(byteGMT)])
+	return append(dst, byteGMT...)
+}
+
+// ParseHTTPDate parses IMF-fixdate and the obsolete RFC 850 and asctime formats
+func ParseHTTPDate(date []byte) (time.Time, error) {
+	for _, layout := range httpDateFormats {
+		if t, err := time.Parse(layout, b2s(date)); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.Wrapf(ErrInvalidHTTPDate, "%q", date)
+}
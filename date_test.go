@@ -0,0 +1,56 @@
+package http1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseHTTPDate(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	tests := []struct {
+		date string
+		ok   bool
+	}{
+		{"Sun, 06 Nov 1994 08:49:37 GMT", true},
+		{"Sunday, 06-Nov-94 08:49:37 GMT", true},
+		{"Sun Nov  6 08:49:37 1994", true},
+		{"Sun, 06 Nov 1994 08:49:37", false},
+		{"", false},
+		{"yesterday", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseHTTPDate([]byte(tt.date))
+		if !tt.ok {
+			if errors.Cause(err) != ErrInvalidHTTPDate {
+				t.Errorf("ParseHTTPDate(%q) error %v, want ErrInvalidHTTPDate", tt.date, err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("ParseHTTPDate(%q) = %v, %v", tt.date, got, err)
+		}
+	}
+}
+
+func TestAppendHTTPDate(t *testing.T) {
+	loc := time.FixedZone("X", 3600)
+	d := time.Date(1994, time.November, 6, 9, 49, 37, 0, loc)
+	if got := string(AppendHTTPDate([]byte("x"), d)); got != "xSun, 06 Nov 1994 08:49:37 GMT" {
+		t.Errorf("AppendHTTPDate = %q", got)
+	}
+}
+
+func TestCurrentDate(t *testing.T) {
+	d, err := ParseHTTPDate(currentDate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := time.Since(d); diff < 0 || diff > 2*time.Second {
+		t.Errorf("Date %v is %v away from now", d, diff)
+	}
+	if n := testing.AllocsPerRun(100, func() { currentDate() }); n > 0.1 {
+		t.Errorf("currentDate allocates %v times per call", n)
+	}
+}
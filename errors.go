@@ -1,7 +1,53 @@
 package http1
 
 import (
+	"github.com/pkg/errors"
 	"github.com/widaT/httparse"
 )
 
 var StatusPartial = httparse.StatusPartial
+
+// ParseError is a request that can't be served.
+// Status is the code of the response sent before the connection is closed.
+type ParseError struct {
+	Status int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Cause() error {
+	return e.Err
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError wraps a parser error with the status it maps to,
+// StatusPartial and errors that are already typed are returned as is
+func newParseError(err error) error {
+	if err == nil || err == StatusPartial {
+		return err
+	}
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	return &ParseError{Status: parseErrorStatus(err), Err: err}
+}
+
+func parseErrorStatus(err error) int {
+	switch errors.Cause(err) {
+	case ErrBodyTooLarge:
+		return StatusRequestEntityTooLarge
+	case ErrURITooLong:
+		return StatusRequestURITooLong
+	case ErrHeaderTooLarge:
+		return StatusRequestHeaderFieldsTooLarge
+	case ErrUnsupportedTransferEncoding:
+		return StatusNotImplemented
+	}
+	return StatusBadRequest
+}
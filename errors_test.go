@@ -0,0 +1,69 @@
+package http1
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseErrorResponses(t *testing.T) {
+	s := NewServer(func(ctx *Context) { t.Error("handler called for a bad request") }, 0)
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"transfer coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", StatusNotImplemented},
+		{"chunk size", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", StatusBadRequest},
+		{"chunk size overflow", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n8000000000000000\r\nabc\r\n0\r\n\r\n", StatusBadRequest},
+		{"content length", "POST / HTTP/1.1\r\nContent-Length: x\r\n\r\n", StatusBadRequest},
+		{"header name", "GET / HTTP/1.1\r\nBad Header: x\r\n\r\n", StatusBadRequest},
+		{"header size", "GET / HTTP/1.1\r\nA: " + strings.Repeat("a", maxHeaderSize) + "\r\n\r\n", StatusRequestHeaderFieldsTooLarge},
+		{"uri length", "GET /" + strings.Repeat("a", maxLineLength) + " HTTP/1.1\r\n\r\n", StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := serveString(s, tt.raw)
+			pe, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("error %v, want a *ParseError", err)
+			}
+			if pe.Status != tt.status {
+				t.Errorf("ParseError.Status %d, want %d", pe.Status, tt.status)
+			}
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if !resp.Close {
+				t.Error("response without Connection: close")
+			}
+		})
+	}
+}
+
+func TestParseErrorIncomplete(t *testing.T) {
+	s := NewServer(func(ctx *Context) {}, 0)
+	out, err := serveString(s, "GET / HTTP/1.1\r\nA: x\r\n")
+	if err != nil || out != "" {
+		t.Errorf("partial request answered with %q, %v", out, err)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	s := NewServer(func(ctx *Context) {}, 0)
+	var cause error
+	s.ErrorHandler = func(ctx *Context, err *ParseError) {
+		cause = err.Err
+		ctx.Response().SetBody([]byte("custom"))
+	}
+	out, _ := serveString(s, "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n")
+	resp := readResponses(t, out, "POST")[0]
+	if resp.StatusCode != StatusNotImplemented || readBody(resp) != "custom" {
+		t.Errorf("got %q", out)
+	}
+	if errors.Cause(cause) != ErrUnsupportedTransferEncoding {
+		t.Errorf("cause %v", cause)
+	}
+}
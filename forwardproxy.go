@@ -0,0 +1,382 @@
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var byteProxyAuthenticate = []byte(`Basic realm="proxy"`)
+
+// ForwardProxy is a handler for clients configured to use this server as their proxy.
+// Absolute-form requests are forwarded like ReverseProxy does, CONNECT host:port is
+// answered with 200 and the connection then relays bytes to the target.
+// The CONNECT target is resolved, dialed, written and read on goroutines of its own,
+// the answer and the target's bytes are written from them, so the Conn implementation
+// must allow Write and Close from another goroutine.
+type ForwardProxy struct {
+	//Authorize checks the Basic credentials of Proxy-Authorization,
+	//clients are not asked for credentials when it is nil
+	Authorize func(user, password []byte) bool
+	//Allow lists the hosts that may be reached: names, '*.example.com', IP addresses
+	//or CIDR ranges. Names match the requested host, addresses every address it
+	//resolves to. Every host is allowed when it is empty
+	Allow []string
+	//Deny lists the hosts that may not be reached in the same forms, it is checked
+	//before Allow and a host is denied when any of its addresses is
+	Deny []string
+	//Resolver looks up the requested hosts, net.DefaultResolver when nil.
+	//The checked address is the one dialed
+	Resolver *net.Resolver
+
+	DialTimeout time.Duration
+
+	proxy     *ReverseProxy
+	once      sync.Once
+	rulesOnce sync.Once
+	allow     hostRules
+	deny      hostRules
+}
+
+// forwardAddrKey holds the checked address a forwarded request is sent to
+type forwardAddrKey struct{}
+
+func NewForwardProxy() *ForwardProxy {
+	return &ForwardProxy{
+		DialTimeout: defaultProxyDialTimeout,
+	}
+}
+
+func (p *ForwardProxy) Handler(ctx *Context) {
+	if !p.authorized(ctx) {
+		ctx.resp.SetStatusCode(StatusProxyAuthRequired)
+		ctx.resp.header.Set(HeaderProxyAuthenticate, byteProxyAuthenticate)
+		return
+	}
+	uri := &ctx.req.uri
+	target := ctx.req.header.URI
+	absolute := !uri.IsAuthority() && !uri.IsAsterisk() && len(target) > 0 && target[0] != '/'
+	connect := ctx.req.IsConnect()
+	//only plain http is forwarded, https goes through CONNECT
+	if (connect && !uri.IsAuthority()) || (!connect && (!absolute || !bytes.Equal(uri.Scheme(), byteHTTP))) {
+		ctx.resp.SetStatusCode(StatusBadRequest)
+		return
+	}
+	addr := hostPort(b2s(uri.Host()), uri.Scheme())
+	if connect {
+		//what can be refused without a lookup is answered here, the tunnel
+		//resolves and dials the target off the event loop
+		if _, status := p.resolve(ctx.Context(), addr, false); status != 0 {
+			ctx.resp.SetStatusCode(status)
+			return
+		}
+		ctx.resp.SetStatusCode(StatusOK)
+		ctx.Hijack(newTunnel(p, addr))
+		ctx.HijackSetNoResponse(true)
+		return
+	}
+	addr, status := p.resolve(ctx.Context(), addr, true)
+	if status != 0 {
+		ctx.resp.SetStatusCode(status)
+		return
+	}
+	p.once.Do(func() {
+		p.proxy = NewReverseProxy("")
+		p.proxy.DialTimeout = p.dialTimeout()
+		p.proxy.Upstream = func(ctx *Context) string {
+			addr, _ := ctx.UserValue(forwardAddrKey{}).(string)
+			return addr
+		}
+	})
+	ctx.SetUserValue(forwardAddrKey{}, addr)
+	p.proxy.Handler(ctx)
+}
+
+func (p *ForwardProxy) authorized(ctx *Context) bool {
+	if p.Authorize == nil {
+		return true
+	}
+	user, password, ok := ctx.req.header.ProxyBasicAuth()
+	return ok && p.Authorize(user, password)
+}
+
+// resolve returns the address to dial for addr, or the status refusing it. The host
+// and each address it resolves to are checked against Deny and Allow, so a name
+// can't lead to a denied address. Without lookup a name that needs one returns
+// neither, only what is known without it is refused
+func (p *ForwardProxy) resolve(c context.Context, addr string, lookup bool) (string, int) {
+	p.rulesOnce.Do(func() {
+		p.allow = newHostRules(p.Allow)
+		p.deny = newHostRules(p.Deny)
+	})
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", StatusBadRequest
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if p.deny.matchName(host) {
+		return "", StatusForbidden
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if !lookup {
+			return "", 0
+		}
+		resolver := p.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		c, cancel := context.WithTimeout(c, p.dialTimeout())
+		addrs, err := resolver.LookupIPAddr(c, host)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			return "", StatusBadGateway
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	nameAllowed := len(p.Allow) == 0 || p.allow.matchName(host)
+	var dial net.IP
+	for _, ip := range ips {
+		if p.deny.matchIP(ip) {
+			return "", StatusForbidden
+		}
+		if dial == nil && (nameAllowed || p.allow.matchIP(ip)) {
+			dial = ip
+		}
+	}
+	if dial == nil {
+		return "", StatusForbidden
+	}
+	return net.JoinHostPort(dial.String(), port), 0
+}
+
+func (p *ForwardProxy) dialTimeout() time.Duration {
+	if p.DialTimeout > 0 {
+		return p.DialTimeout
+	}
+	return defaultProxyDialTimeout
+}
+
+// hostRules are the Allow or Deny patterns split into names and address ranges
+type hostRules struct {
+	names []string
+	nets  []*net.IPNet
+}
+
+func newHostRules(patterns []string) hostRules {
+	var r hostRules
+	for _, pattern := range patterns {
+		if _, n, err := net.ParseCIDR(pattern); err == nil {
+			r.nets = append(r.nets, n)
+		} else if ip := net.ParseIP(pattern); ip != nil {
+			bits := 8 * len(ip)
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			r.names = append(r.names, strings.TrimSuffix(strings.ToLower(pattern), "."))
+		}
+	}
+	return r
+}
+
+func (r *hostRules) matchName(host string) bool {
+	for _, pattern := range r.names {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *hostRules) matchIP(ip net.IP) bool {
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost matches host against an exact name or a '*.example.com' pattern
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return len(host) > len(pattern)-1 && strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// hostPort adds the default port of scheme when host has none
+func hostPort(host string, scheme []byte) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if string(scheme) == string(byteHTTPS) {
+		return net.JoinHostPort(strings.Trim(host, "[]"), "443")
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "80")
+}
+
+// maxTunnelPending bounds the client bytes a tunnel holds for a slow target,
+// past it Serve waits for the target to catch up
+const maxTunnelPending = 1 << 20
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// tunnel relays the bytes of a hijacked connection to the CONNECT target and back.
+// It answers the CONNECT request once the target is dialed, the client bytes that
+// arrive before are held until then
+type tunnel struct {
+	proxy *ForwardProxy
+	addr  string
+
+	mu       sync.Mutex
+	cond     sync.Cond //signalled when pending is taken or the tunnel closes
+	conn     Conn
+	upstream net.Conn
+	pending  []byte //client bytes waiting for the target
+	closed   bool   //once set nothing is written to or closes conn, it may be reused
+}
+
+func newTunnel(p *ForwardProxy, addr string) *tunnel {
+	t := &tunnel{proxy: p, addr: addr}
+	t.cond.L = &t.mu
+	return t
+}
+
+func (t *tunnel) Serve(c Conn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		t.conn = c
+		go t.run()
+	}
+	for len(t.pending) >= maxTunnelPending && !t.closed {
+		t.cond.Wait()
+	}
+	if t.closed {
+		return errTunnelClosed
+	}
+	buf, err := c.Bytes()
+	if err != nil {
+		return err
+	}
+	t.pending = append(t.pending, buf...)
+	c.Shift(len(buf))
+	t.cond.Broadcast()
+	return nil
+}
+
+// run dials the target, answers the CONNECT request and writes the client bytes to the target
+func (t *tunnel) run() {
+	status := StatusOK
+	addr, refused := t.proxy.resolve(context.Background(), t.addr, true)
+	var upstream net.Conn
+	if refused != 0 {
+		status = refused
+	} else {
+		var err error
+		if upstream, err = net.DialTimeout("tcp", addr, t.proxy.dialTimeout()); err != nil {
+			status = StatusBadGateway
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				status = StatusGatewayTimeout
+			}
+		}
+	}
+	t.mu.Lock()
+	if t.closed || status != StatusOK {
+		t.mu.Unlock()
+		if upstream != nil {
+			upstream.Close()
+		}
+		t.respond(status)
+		t.shutdown()
+		return
+	}
+	t.upstream = upstream
+	t.mu.Unlock()
+	if t.respond(StatusOK) != nil {
+		t.shutdown()
+		return
+	}
+	go func() {
+		bufCopy(t, upstream)
+		t.shutdown()
+	}()
+
+	var buf []byte
+	for {
+		t.mu.Lock()
+		for len(t.pending) == 0 && !t.closed {
+			t.cond.Wait()
+		}
+		if t.closed {
+			t.mu.Unlock()
+			return
+		}
+		buf, t.pending = t.pending, buf[:0]
+		t.cond.Broadcast()
+		t.mu.Unlock()
+		if _, err := upstream.Write(buf); err != nil {
+			t.shutdown()
+			return
+		}
+	}
+}
+
+// respond writes the answer to the CONNECT request, only 200 keeps the connection
+func (t *tunnel) respond(status int) error {
+	h := NewResponseHeader()
+	h.StatusCode = status
+	h.ContentType = nil
+	h.hijacked = status == StatusOK
+	h.Close = status != StatusOK
+	w := bufio.NewWriterSize(t, 256)
+	h.Write(w)
+	return w.Flush()
+}
+
+// Write writes p to the client connection unless the tunnel was closed
+func (t *tunnel) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, errTunnelClosed
+	}
+	return t.conn.Write(p)
+}
+
+// shutdown ends the tunnel from its side, the client connection is closed
+// unless the context released the tunnel first
+func (t *tunnel) shutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.conn.Close()
+	}
+	t.closeLocked()
+}
+
+// Close is called when the context is released, the connection is left to the server
+func (t *tunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeLocked()
+	return nil
+}
+
+func (t *tunnel) closeLocked() {
+	t.closed = true
+	if t.upstream != nil {
+		t.upstream.Close()
+	}
+	t.cond.Broadcast()
+}
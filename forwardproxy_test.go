@@ -0,0 +1,154 @@
+package http1
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardProxy(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s host=%s pa=%q", r.Method, r.URL, r.Host, r.Header.Get(HeaderProxyAuthorization))
+	}))
+	defer up.Close()
+	_, port, _ := net.SplitHostPort(up.Listener.Addr().String())
+	auth := "Proxy-Authorization: Basic dTpw\r\n" //u:p
+
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		raw    string
+		status int
+		body   string
+	}{
+		{"forwarded", nil, nil, "GET http://127.0.0.1:" + port + "/x?y=1 HTTP/1.1\r\nHost: 127.0.0.1:" + port + "\r\n" + auth + "\r\n",
+			200, `GET /x?y=1 host=127.0.0.1:` + port + ` pa=""`},
+		{"target replaces host", nil, nil, "GET http://127.0.0.1:" + port + "/ HTTP/1.1\r\nHost: other\r\n" + auth + "\r\n",
+			200, `GET / host=127.0.0.1:` + port + ` pa=""`},
+		{"no credentials", nil, nil, "GET http://127.0.0.1:" + port + "/x HTTP/1.1\r\n\r\n", StatusProxyAuthRequired, ""},
+		{"origin form", nil, nil, "GET /x HTTP/1.1\r\n" + auth + "\r\n", StatusBadRequest, ""},
+		{"https scheme", nil, nil, "GET https://127.0.0.1:" + port + "/ HTTP/1.1\r\n" + auth + "\r\n", StatusBadRequest, ""},
+		{"ftp scheme", nil, nil, "GET ftp://127.0.0.1:" + port + "/ HTTP/1.1\r\n" + auth + "\r\n", StatusBadRequest, ""},
+		{"denied name", nil, []string{"*.bad.com"}, "CONNECT a.bad.com:443 HTTP/1.1\r\n" + auth + "\r\n", StatusForbidden, ""},
+		{"denied address behind a name", nil, []string{"127.0.0.0/8", "::1"}, "GET http://localhost:" + port + "/ HTTP/1.1\r\n" + auth + "\r\n", StatusForbidden, ""},
+		{"denied address", nil, []string{"127.0.0.1"}, "CONNECT 127.0.0.1:" + port + " HTTP/1.1\r\n" + auth + "\r\n", StatusForbidden, ""},
+		{"not allowed", []string{"example.com"}, nil, "GET http://127.0.0.1:" + port + "/ HTTP/1.1\r\n" + auth + "\r\n", StatusForbidden, ""},
+		{"allowed range", []string{"127.0.0.0/8"}, nil, "GET http://localhost:" + port + "/ HTTP/1.1\r\n" + auth + "\r\n",
+			200, `GET / host=localhost:` + port + ` pa=""`},
+		{"unresolvable", nil, nil, "GET http://nonexistent.invalid/ HTTP/1.1\r\n" + auth + "\r\n", StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := NewForwardProxy()
+			fp.Authorize = func(u, p []byte) bool { return string(u) == "u" && string(p) == "p" }
+			fp.Allow, fp.Deny = tt.allow, tt.deny
+			method := strings.SplitN(tt.raw, " ", 2)[0]
+			out, _ := serveString(NewServer(fp.Handler, 0), tt.raw)
+			resp := readResponses(t, out, method)[0]
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" {
+				if body := readBody(resp); body != tt.body {
+					t.Errorf("body %q, want %q", body, tt.body)
+				}
+			}
+			if tt.status == StatusProxyAuthRequired && resp.Header.Get(HeaderProxyAuthenticate) == "" {
+				t.Error("no Proxy-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestForwardProxyTunnel(t *testing.T) {
+	released := make(chan struct{}, 1)
+	echo := rawUpstream(t, func(c net.Conn, br *bufio.Reader) {
+		io.Copy(c, br)
+		released <- struct{}{}
+	})
+	bye := rawUpstream(t, func(c net.Conn, br *bufio.Reader) {
+		c.Write([]byte("bye"))
+	})
+	//a lookup taking longer than the test waits for ServeHttp
+	slow := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		time.Sleep(200 * time.Millisecond)
+		return nil, errors.New("no dns")
+	}}
+	tests := []struct {
+		name     string
+		addr     string
+		resolver *net.Resolver
+		feed     string
+		out      string //the output once the tunnel settled, after the response head
+		status   string
+		closed   bool
+	}{
+		{"echo", echo, nil, " world", "hello world", "HTTP/1.1 200 OK\r\n", false},
+		{"target closes", bye, nil, "", "bye", "HTTP/1.1 200 OK\r\n", true},
+		{"refused", "127.0.0.1:1", nil, "", "", "HTTP/1.1 502 Bad Gateway\r\n", true},
+		{"slow lookup", "slow.example:443", slow, "", "", "HTTP/1.1 502 Bad Gateway\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := NewForwardProxy()
+			fp.Resolver = tt.resolver
+			c := newTestConn("CONNECT " + tt.addr + " HTTP/1.1\r\n\r\nhello")
+			ctx := AcquireContext(NewServer(fp.Handler, 0), c)
+			start := time.Now()
+			if err := ctx.ServeHttp(); err != nil {
+				t.Fatal(err)
+			}
+			//the lookup and the dial don't hold the event loop
+			if d := time.Since(start); d > 100*time.Millisecond {
+				t.Errorf("ServeHttp took %v", d)
+			}
+			if tt.feed != "" {
+				c.feed(tt.feed)
+				if err := ctx.ServeHttp(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for !(strings.HasSuffix(c.output(), "\r\n\r\n"+tt.out) && c.isClosed() == tt.closed) && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			out := c.output()
+			if !strings.HasPrefix(out, tt.status) || !strings.HasSuffix(out, "\r\n\r\n"+tt.out) || c.isClosed() != tt.closed {
+				t.Fatalf("output %q, closed %v", out, c.isClosed())
+			}
+			//only an answer refusing the tunnel is framed and closes the connection
+			established := strings.HasPrefix(out, "HTTP/1.1 200")
+			if established == strings.Contains(out, "Connection: close") {
+				t.Errorf("Connection: close %v in %q", established, out)
+			}
+			if strings.Contains(out, "Transfer-Encoding") || established == strings.Contains(out, "Content-Length: 0") {
+				t.Errorf("CONNECT response carries body framing: %q", out)
+			}
+			if tt.closed {
+				ReleaseContext(ctx)
+				return
+			}
+			//releasing the context closes the target, the client connection belongs
+			//to the server again and the tunnel neither writes to it nor closes it
+			ReleaseContext(ctx)
+			select {
+			case <-released:
+			case <-time.After(2 * time.Second):
+				t.Fatal("target connection left open")
+			}
+			time.Sleep(20 * time.Millisecond)
+			if c.isClosed() || c.output() != out {
+				t.Errorf("tunnel used the released connection: closed %v, output %q", c.isClosed(), c.output())
+			}
+		})
+	}
+}
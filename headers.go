@@ -1,5 +1,7 @@
 package http1
 
+import "bytes"
+
 const (
 	MethodGet     = "GET"
 	MethodHead    = "HEAD"
@@ -167,10 +169,36 @@ const (
 	HeaderSignature           = "Signature"
 	HeaderSignedHeaders       = "Signed-Headers"
 	HeaderSourceMap           = "SourceMap"
+	HeaderTraceparent         = "Traceparent"
+	HeaderTracestate          = "Tracestate"
 	HeaderUpgrade             = "Upgrade"
 	HeaderXDNSPrefetchControl = "X-DNS-Prefetch-Control"
 	HeaderXPingback           = "X-Pingback"
+	HeaderXRequestID          = "X-Request-Id"
 	HeaderXRequestedWith      = "X-Requested-With"
 	HeaderXRobotsTag          = "X-Robots-Tag"
 	HeaderXUACompatible       = "X-UA-Compatible"
 )
+
+// HeaderParams are the raw ';' separated parameters of a header value such as Content-Type
+type HeaderParams []byte
+
+// Get returns the value of the named parameter without quotes, names are case-insensitive
+func (p HeaderParams) Get(name string) []byte {
+	for len(p) > 0 {
+		var param []byte
+		if i := bytes.IndexByte(p, ';'); i >= 0 {
+			param, p = p[:i], p[i+1:]
+		} else {
+			param, p = p, nil
+		}
+		i := bytes.IndexByte(param, '=')
+		if i < 0 {
+			continue
+		}
+		if equalFoldString(b2s(bytes.TrimSpace(param[:i])), name) {
+			return trimQuotes(bytes.TrimSpace(param[i+1:]))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package http1
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const maxJSONBodySize = 1 << 20
+
+var (
+	byteApplicationJSON = []byte("application/json")
+	byteProblemJSON     = []byte("application/problem+json")
+	byteNDJSON          = []byte("application/x-ndjson")
+	byteJSONSuffix      = []byte("+json")
+)
+
+// Problem is an RFC 7807 problem details body, it is also the error BindJSON returns
+type Problem struct {
+	Type   string       `json:"type,omitempty"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError points at the part of a JSON body that could not be decoded,
+// Field is the dotted path of the struct field when it is known
+type FieldError struct {
+	Field  string `json:"field,omitempty"`
+	Detail string `json:"detail"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return strconv.Itoa(p.Status) + " " + p.Title + ": " + p.Detail
+	}
+	return strconv.Itoa(p.Status) + " " + p.Title
+}
+
+// Problem answers with p as application/problem+json, an empty Title is the status reason
+func (ctx *Context) Problem(p *Problem) error {
+	if p.Status == 0 {
+		p.Status = StatusBadRequest
+	}
+	if p.Title == "" {
+		p.Title = reason(p.Status)
+	}
+	if err := ctx.JSON(p.Status, p); err != nil {
+		return err
+	}
+	ctx.resp.SetContentType(byteProblemJSON)
+	return nil
+}
+
+// BindJSON decodes the request body into v. A body that isn't JSON, is larger than
+// Limits.MaxJSONBodySize or doesn't decode into v is answered with 415, 413 or 400
+// and the *Problem sent is returned, the handler only has to stop
+func (ctx *Context) BindJSON(v interface{}) error {
+	p := ctx.bindJSON(v)
+	if p == nil {
+		return nil
+	}
+	if err := ctx.Problem(p); err != nil {
+		return err
+	}
+	return p
+}
+
+func (ctx *Context) bindJSON(v interface{}) *Problem {
+	mediaType, _ := ctx.req.header.ContentType()
+	if !isJSONMediaType(mediaType) {
+		return &Problem{
+			Status: StatusUnsupportedMediaType,
+			Detail: "Content-Type must be application/json",
+		}
+	}
+	body := ctx.req.Body()
+	if limit := ctx.req.limits.jsonBodySize(); len(body) > limit {
+		return &Problem{
+			Status: StatusRequestEntityTooLarge,
+			Detail: "body is larger than " + strconv.Itoa(limit) + " bytes",
+		}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &Problem{Status: StatusBadRequest, Detail: "body is empty"}
+	}
+	err := json.Unmarshal(body, v)
+	if err == nil {
+		return nil
+	}
+	p := &Problem{Status: StatusBadRequest, Detail: "body is not valid JSON"}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		p.Errors = []FieldError{{
+			Detail: e.Error() + " at offset " + strconv.FormatInt(e.Offset, 10),
+		}}
+	case *json.UnmarshalTypeError:
+		p.Detail = "body does not match the expected fields"
+		p.Errors = []FieldError{{
+			Field:  e.Field,
+			Detail: "cannot use " + e.Value + " as " + e.Type.String(),
+		}}
+	default:
+		p.Errors = []FieldError{{Detail: err.Error()}}
+	}
+	return p
+}
+
+func hasPrefixFold(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && bytes.EqualFold(b[:len(prefix)], prefix)
+}
+
+func isJSONMediaType(mediaType []byte) bool {
+	if bytes.EqualFold(mediaType, byteApplicationJSON) {
+		return true
+	}
+	//application/problem+json, application/vnd.api+json ...
+	n := len(mediaType) - len(byteJSONSuffix)
+	return n > 0 && bytes.EqualFold(mediaType[n:], byteJSONSuffix) &&
+		hasPrefixFold(mediaType, byteApplicationSlash)
+}
+
+// JSON answers with status and v encoded into the response body buffer.
+// The body is left empty when v can't be encoded
+func (ctx *Context) JSON(status int, v interface{}) error {
+	body := ctx.resp.bodyBuffer()
+	body.Reset()
+	if err := json.NewEncoder(body).Encode(v); err != nil {
+		body.Reset()
+		return errors.WithStack(err)
+	}
+	ctx.resp.SetStatusCode(status)
+	ctx.resp.SetContentType(byteApplicationJSON)
+	return nil
+}
+
+// NDJSON answers with status and streams newline delimited JSON written by fn,
+// fn runs after the handler returns once the headers are sent. An error from fn
+// ends the body early and closes the connection
+func (ctx *Context) NDJSON(status int, fn func(w *NDJSONWriter) error) {
+	ctx.resp.SetStatusCode(status)
+	ctx.resp.SetContentType(byteNDJSON)
+	ctx.resp.SetBodyStreamWriter(func(w io.Writer) error {
+		nw := NDJSONWriter{w: w, enc: json.NewEncoder(w)}
+		return fn(&nw)
+	})
+}
+
+// NDJSONWriter writes one JSON value per line into a chunked response
+type NDJSONWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// Encode writes v followed by a newline
+func (w *NDJSONWriter) Encode(v interface{}) error {
+	return w.enc.Encode(v)
+}
+
+// Flush sends the lines written so far to the client
+func (w *NDJSONWriter) Flush() error {
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
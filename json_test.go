@@ -0,0 +1,112 @@
+package http1
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBindJSON(t *testing.T) {
+	type person struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	s := NewServer(func(ctx *Context) {
+		var v person
+		if err := ctx.BindJSON(&v); err != nil {
+			if _, ok := err.(*Problem); !ok {
+				t.Errorf("BindJSON returned %T", err)
+			}
+			return
+		}
+		ctx.JSON(StatusCreated, v)
+	}, 0)
+	s.Limits.MaxJSONBodySize = 32
+	post := func(contentType, body string) string {
+		return "POST / HTTP/1.1\r\nHost: a\r\nContent-Type: " + contentType +
+			"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	}
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+		body   string
+		field  string
+	}{
+		{"valid", post("application/json; charset=utf-8", `{"name":"x","age":3}`), StatusCreated, `{"name":"x","age":3}` + "\n", ""},
+		{"json suffix", post("application/vnd.api+json", `{"name":"y"}`), StatusCreated, `{"name":"y","age":0}` + "\n", ""},
+		{"text", post("text/plain", `{}`), StatusUnsupportedMediaType, "", ""},
+		{"bare suffix", post("+json", `{}`), StatusUnsupportedMediaType, "", ""},
+		{"missing content type", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\n{}", StatusUnsupportedMediaType, "", ""},
+		{"too large", post("application/json", `{"name":"`+strings.Repeat("x", 32)+`"}`), StatusRequestEntityTooLarge, "", ""},
+		{"empty", post("application/json", " "), StatusBadRequest, "", ""},
+		{"syntax", post("application/json", `{"nam`), StatusBadRequest, "", ""},
+		{"field type", post("application/json", `{"name":"x","age":"no"}`), StatusBadRequest, "", "age"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := serveString(s, tt.raw)
+			resp := readResponses(t, out, "POST")[0]
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			body := readBody(resp)
+			if tt.status == StatusCreated {
+				if body != tt.body || resp.Header.Get(HeaderContentType) != "application/json" {
+					t.Errorf("body %q type %q", body, resp.Header.Get(HeaderContentType))
+				}
+				return
+			}
+			if resp.Header.Get(HeaderContentType) != "application/problem+json" {
+				t.Errorf("content type %q", resp.Header.Get(HeaderContentType))
+			}
+			var p Problem
+			if err := json.Unmarshal([]byte(body), &p); err != nil {
+				t.Fatalf("problem body %q: %v", body, err)
+			}
+			if p.Status != tt.status || p.Title != reason(tt.status) || p.Detail == "" {
+				t.Errorf("problem %+v", p)
+			}
+			if tt.field != "" && (len(p.Errors) != 1 || p.Errors[0].Field != tt.field) {
+				t.Errorf("field errors %+v, want %q", p.Errors, tt.field)
+			}
+		})
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	s := NewServer(func(ctx *Context) {
+		ctx.NDJSON(StatusOK, func(w *NDJSONWriter) error {
+			for i := 0; i < 3; i++ {
+				if err := w.Encode(map[string]int{"i": i}); err != nil {
+					return err
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}, 0)
+	out, err := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := readResponses(t, out, "GET")[0]
+	if len(resp.TransferEncoding) == 0 || resp.Header.Get(HeaderContentType) != "application/x-ndjson" {
+		t.Errorf("headers %v %v", resp.TransferEncoding, resp.Header)
+	}
+	if body := readBody(resp); body != "{\"i\":0}\n{\"i\":1}\n{\"i\":2}\n" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestProblemDefaults(t *testing.T) {
+	s := NewServer(func(ctx *Context) { ctx.Problem(&Problem{Detail: "d"}) }, 0)
+	out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	resp := readResponses(t, out, "GET")[0]
+	if body := readBody(resp); resp.StatusCode != StatusBadRequest || body != `{"title":"Bad Request","status":400,"detail":"d"}`+"\n" {
+		t.Errorf("status %d body %q", resp.StatusCode, body)
+	}
+}
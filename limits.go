@@ -0,0 +1,49 @@
+package http1
+
+// Limits bounds what a client may send on a connection.
+// A zero field means the default for the header and JSON sizes and no limit for the others.
+type Limits struct {
+	//MaxHeaderBytes is the size of the request line and headers, 431 when exceeded
+	MaxHeaderBytes int
+	//MaxHeaderCount is the number of header fields, 431 when exceeded
+	MaxHeaderCount int
+	//MaxRequestLineLength is the size of the request line, 414 when exceeded
+	MaxRequestLineLength int
+	//MaxBodySize is the size of the decoded body, 413 when exceeded
+	MaxBodySize int
+	//MaxChunkLineLength is the size of a chunk size line or trailer line, 400 when exceeded
+	MaxChunkLineLength int
+	//MaxPipelinedRequests is the number of requests answered back to back from
+	//already buffered data, the connection is closed after the last one
+	MaxPipelinedRequests int
+	//MaxJSONBodySize is the size of a body decoded by Context.BindJSON, 413 when exceeded
+	MaxJSONBodySize int
+}
+
+func (l *Limits) headerBytes() int {
+	if l.MaxHeaderBytes > 0 {
+		return l.MaxHeaderBytes
+	}
+	return maxHeaderSize
+}
+
+func (l *Limits) requestLineLength() int {
+	if l.MaxRequestLineLength > 0 {
+		return l.MaxRequestLineLength
+	}
+	return maxLineLength
+}
+
+func (l *Limits) chunkLineLength() int {
+	if l.MaxChunkLineLength > 0 {
+		return l.MaxChunkLineLength
+	}
+	return maxLineLength
+}
+
+func (l *Limits) jsonBodySize() int {
+	if l.MaxJSONBodySize > 0 {
+		return l.MaxJSONBodySize
+	}
+	return maxJSONBodySize
+}
@@ -0,0 +1,105 @@
+package http1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxHeaderBytes:       256,
+		MaxHeaderCount:       3,
+		MaxRequestLineLength: 64,
+		MaxBodySize:          4,
+		MaxChunkLineLength:   16,
+	}
+	s := NewServer(func(ctx *Context) { ctx.Response().SetBody(ctx.Request().Body()) }, 0)
+	s.Limits = limits
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"request line", "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n", StatusRequestURITooLong},
+		{"header bytes", "GET / HTTP/1.1\r\nA: " + strings.Repeat("a", 256) + "\r\n\r\n", StatusRequestHeaderFieldsTooLarge},
+		{"header count", "GET / HTTP/1.1\r\nA: 1\r\nB: 1\r\nC: 1\r\nD: 1\r\n\r\n", StatusRequestHeaderFieldsTooLarge},
+		{"repeated fields count", "GET / HTTP/1.1\r\nA: 1\r\nA: 1\r\nA: 1\r\nA: 1\r\n\r\n", StatusRequestHeaderFieldsTooLarge},
+		{"header count at limit", "GET / HTTP/1.1\r\nA: 1\r\nA: 1\r\nB: 1\r\n\r\n", StatusOK},
+		{"content length", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nabcde", StatusRequestEntityTooLarge},
+		{"chunked body", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\nabc\r\n0\r\n\r\n", StatusRequestEntityTooLarge},
+		{"chunk line", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1;" + strings.Repeat("x", 20) + "\r\na\r\n0\r\n\r\n", StatusBadRequest},
+		{"body at limit", "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nabcd", StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := serveString(s, tt.raw)
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestMaxPipelinedRequests(t *testing.T) {
+	s := NewServer(func(ctx *Context) {}, 0)
+	s.Limits.MaxPipelinedRequests = 2
+	raw := strings.Repeat("GET / HTTP/1.1\r\n\r\n", 4)
+	out, err := serveString(s, raw)
+	if err != errShouldClose {
+		t.Errorf("error %v, want errShouldClose", err)
+	}
+	resps := readResponses(t, out, "GET", "GET")
+	if resps[0].Close || !resps[1].Close {
+		t.Errorf("close %v %v, want the second response to close", resps[0].Close, resps[1].Close)
+	}
+}
+
+func TestMaxServeTimesPerConn(t *testing.T) {
+	tests := []struct {
+		max   uint64
+		resps int
+	}{
+		{0, 3},
+		{1, 1},
+		{2, 2},
+		{3, 3},
+	}
+	for _, tt := range tests {
+		s := NewServer(func(ctx *Context) {}, tt.max)
+		out, _ := serveString(s, strings.Repeat("GET / HTTP/1.1\r\n\r\n", 3))
+		methods := strings.Fields(strings.Repeat("GET ", tt.resps))
+		resps := readResponses(t, out, methods...)
+		for i, resp := range resps {
+			//only the response to the last allowed request closes the connection
+			if want := tt.max > 0 && i == tt.resps-1; resp.Close != want {
+				t.Errorf("max %d: response %d close %v", tt.max, i, resp.Close)
+			}
+		}
+	}
+}
+
+func TestHeaderLines(t *testing.T) {
+	tests := []struct {
+		head string
+		n    int
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", 0},
+		{"GET / HTTP/1.1\r\nA: 1\r\n\r\n", 1},
+		{"GET / HTTP/1.1\r\nA: 1\r\nA: 2\r\nB: 3\r\n\r\n", 3},
+		{"GET / HTTP/1.1\nA: 1\n\n", 1},
+	}
+	for _, tt := range tests {
+		if n := headerLines([]byte(tt.head)); n != tt.n {
+			t.Errorf("headerLines(%q) = %d, want %d", tt.head, n, tt.n)
+		}
+	}
+}
+
+func TestRequestSetMaxBodySize(t *testing.T) {
+	r := NewRequst("")
+	r.Set(10)
+	if r.MaxBodySize != 10 {
+		t.Errorf("MaxBodySize %d, want 10", r.MaxBodySize)
+	}
+}
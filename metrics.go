@@ -0,0 +1,267 @@
+package http1
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/bytebufferpool"
+)
+
+var byteMetricsContentType = []byte("text/plain; version=0.0.4; charset=utf-8")
+
+var metricMethods = [...]string{
+	MethodGet, MethodHead, MethodPost, MethodPut, MethodPatch,
+	MethodDelete, MethodOptions, MethodConnect, MethodTrace, "OTHER",
+}
+
+var parseErrorKinds = [...]string{
+	"malformed", "line_too_long", "uri_too_long", "header_too_large",
+	"body_too_large", "unsupported_transfer_encoding",
+}
+
+var (
+	durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{0, 64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+)
+
+// contextPool is shared by all servers, so are its counters
+var contextPoolHits, contextPoolMisses uint64
+
+// maxPooledBufferSize keeps buffers grown by very large bodies out of the pools
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool pools body buffers and counts how often Get reused one
+type bufferPool struct {
+	hits, misses uint64
+	pool         sync.Pool
+}
+
+func (p *bufferPool) Get() *bytebufferpool.ByteBuffer {
+	if v := p.pool.Get(); v != nil {
+		atomic.AddUint64(&p.hits, 1)
+		return v.(*bytebufferpool.ByteBuffer)
+	}
+	atomic.AddUint64(&p.misses, 1)
+	return &bytebufferpool.ByteBuffer{}
+}
+
+func (p *bufferPool) Put(b *bytebufferpool.ByteBuffer) {
+	if cap(b.B) > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	p.pool.Put(b)
+}
+
+// Metrics counts what the servers it is set on do, Handler serves the
+// counters in the Prometheus text exposition format. The zero value is ready to use
+type Metrics struct {
+	requests     [len(metricMethods)][5]uint64 //by method and status class 1xx..5xx
+	duration     histogram
+	requestSize  histogram
+	responseSize histogram
+
+	connsActive   int64
+	connsTotal    uint64
+	keepAliveReqs uint64 //requests after the first on a connection
+
+	continueSent    uint64
+	continueRefused uint64
+	parseErrors     [len(parseErrorKinds)]uint64
+
+	once sync.Once
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 //per bucket, the last one is +Inf
+	sum    uint64   //math.Float64bits
+	count  uint64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.once.Do(m.init)
+	return m
+}
+
+// init makes the histograms, it runs once before they are first used
+func (m *Metrics) init() {
+	m.duration = newHistogram(durationBuckets)
+	m.requestSize = newHistogram(sizeBuckets)
+	m.responseSize = newHistogram(sizeBuckets)
+}
+
+func (m *Metrics) connOpened() {
+	atomic.AddInt64(&m.connsActive, 1)
+	atomic.AddUint64(&m.connsTotal, 1)
+}
+
+func (m *Metrics) connClosed() {
+	atomic.AddInt64(&m.connsActive, -1)
+}
+
+func (m *Metrics) observe(ctx *Context) {
+	class := ctx.resp.header.StatusCode/100 - 1
+	if class < 0 || class > 4 {
+		class = 4
+	}
+	method := ctx.req.header.Method
+	if ctx.head {
+		method = byteHead
+	}
+	atomic.AddUint64(&m.requests[metricMethodIndex(method)][class], 1)
+	if ctx.connRequestNum > 1 {
+		atomic.AddUint64(&m.keepAliveReqs, 1)
+	}
+	m.once.Do(m.init)
+	m.duration.observe(time.Since(ctx.start).Seconds())
+	m.requestSize.observe(float64(ctx.req.bodySize()))
+	m.responseSize.observe(float64(ctx.resp.sent))
+}
+
+func (m *Metrics) parseError(err error) {
+	kind := 0
+	switch errors.Cause(err) {
+	case ErrLineTooLong:
+		kind = 1
+	case ErrURITooLong:
+		kind = 2
+	case ErrHeaderTooLarge:
+		kind = 3
+	case ErrBodyTooLarge:
+		kind = 4
+	case ErrUnsupportedTransferEncoding:
+		kind = 5
+	}
+	atomic.AddUint64(&m.parseErrors[kind], 1)
+}
+
+func metricMethodIndex(method []byte) int {
+	for i, m := range metricMethods[:len(metricMethods)-1] {
+		if b2s(method) == m {
+			return i
+		}
+	}
+	return len(metricMethods) - 1
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler(ctx *Context) {
+	body := ctx.resp.bodyBuffer()
+	body.Reset()
+	body.B = m.appendText(body.B)
+	ctx.resp.SetContentType(byteMetricsContentType)
+}
+
+func (m *Metrics) appendText(b []byte) []byte {
+	m.once.Do(m.init)
+	b = appendMetricHeader(b, "http1_requests_total", "counter", "Requests answered, by method and status class.")
+	for i := range m.requests {
+		for class := range m.requests[i] {
+			n := atomic.LoadUint64(&m.requests[i][class])
+			if n == 0 {
+				continue
+			}
+			b = append(b, `http1_requests_total{method="`...)
+			b = append(b, metricMethods[i]...)
+			b = append(b, `",code="`...)
+			b = append(b, byte('1'+class), 'x', 'x', '"', '}', ' ')
+			b = strconv.AppendUint(b, n, 10)
+			b = append(b, '\n')
+		}
+	}
+	b = m.duration.appendText(b, "http1_request_duration_seconds", "Time from the first request byte to the response being written.")
+	b = m.requestSize.appendText(b, "http1_request_body_bytes", "Decoded request body sizes.")
+	b = m.responseSize.appendText(b, "http1_response_body_bytes", "Response body bytes written.")
+
+	b = appendMetricHeader(b, "http1_connections_active", "gauge", "Connections being served.")
+	b = appendMetric(b, "http1_connections_active", "", float64(atomic.LoadInt64(&m.connsActive)))
+	b = appendMetricHeader(b, "http1_connections_total", "counter", "Connections accepted.")
+	b = appendMetric(b, "http1_connections_total", "", float64(atomic.LoadUint64(&m.connsTotal)))
+	b = appendMetricHeader(b, "http1_keepalive_requests_total", "counter", "Requests served on a reused connection.")
+	b = appendMetric(b, "http1_keepalive_requests_total", "", float64(atomic.LoadUint64(&m.keepAliveReqs)))
+
+	b = appendMetricHeader(b, "http1_expect_continue_total", "counter", "Expect: 100-continue requests, by outcome.")
+	b = appendMetric(b, "http1_expect_continue_total", `result="continue"`, float64(atomic.LoadUint64(&m.continueSent)))
+	b = appendMetric(b, "http1_expect_continue_total", `result="refused"`, float64(atomic.LoadUint64(&m.continueRefused)))
+
+	b = appendMetricHeader(b, "http1_parse_errors_total", "counter", "Requests rejected while parsing, by error.")
+	for i, kind := range parseErrorKinds {
+		b = appendMetric(b, "http1_parse_errors_total", `type="`+kind+`"`, float64(atomic.LoadUint64(&m.parseErrors[i])))
+	}
+
+	b = appendMetricHeader(b, "http1_pool_gets_total", "counter", "Pooled object requests, by pool and whether a pooled object was reused.")
+	b = appendMetric(b, "http1_pool_gets_total", `pool="context",result="hit"`, float64(atomic.LoadUint64(&contextPoolHits)))
+	b = appendMetric(b, "http1_pool_gets_total", `pool="context",result="miss"`, float64(atomic.LoadUint64(&contextPoolMisses)))
+	b = appendMetric(b, "http1_pool_gets_total", `pool="request_body",result="hit"`, float64(atomic.LoadUint64(&requestBodyPool.hits)))
+	b = appendMetric(b, "http1_pool_gets_total", `pool="request_body",result="miss"`, float64(atomic.LoadUint64(&requestBodyPool.misses)))
+	b = appendMetric(b, "http1_pool_gets_total", `pool="response_body",result="hit"`, float64(atomic.LoadUint64(&responseBytePool.hits)))
+	b = appendMetric(b, "http1_pool_gets_total", `pool="response_body",result="miss"`, float64(atomic.LoadUint64(&responseBytePool.misses)))
+	return b
+}
+
+func (h *histogram) appendText(b []byte, name, help string) []byte {
+	b = appendMetricHeader(b, name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		b = appendMetric(b, name+"_bucket", `le="`+strconv.FormatFloat(bound, 'f', -1, 64)+`"`, float64(cumulative))
+	}
+	count := atomic.LoadUint64(&h.count)
+	b = appendMetric(b, name+"_bucket", `le="+Inf"`, float64(count))
+	b = appendMetric(b, name+"_sum", "", math.Float64frombits(atomic.LoadUint64(&h.sum)))
+	return appendMetric(b, name+"_count", "", float64(count))
+}
+
+func appendMetricHeader(b []byte, name, typ, help string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, typ...)
+	return append(b, '\n')
+}
+
+func appendMetric(b []byte, name, labels string, v float64) []byte {
+	b = append(b, name...)
+	if labels != "" {
+		b = append(b, '{')
+		b = append(b, labels...)
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		b = strconv.AppendInt(b, int64(v), 10)
+	} else {
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+	return append(b, '\n')
+}
@@ -0,0 +1,87 @@
+package http1
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Metrics
+	}{
+		{"constructor", NewMetrics()},
+		{"zero value", &Metrics{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(func(ctx *Context) { ctx.Response().SetBody([]byte("hello")) }, 0)
+			s.Metrics = tt.m
+			serveString(s, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nExpect: 100-continue\r\n\r\nabcHEAD / HTTP/1.1\r\nHost: a\r\n\r\n")
+			serveString(s, "BREW / HTTP/1.1\r\nHost: a\r\n\r\n")
+			serveString(s, "GET / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: foo\r\n\r\n")
+			s.Handler = tt.m.Handler
+			out, _ := serveString(s, "GET /metrics HTTP/1.1\r\nHost: a\r\n\r\n")
+			resp := readResponses(t, out, "GET")[0]
+			if ct := resp.Header.Get(HeaderContentType); ct != "text/plain; version=0.0.4; charset=utf-8" {
+				t.Errorf("content type %q", ct)
+			}
+			text := readBody(resp)
+			for _, line := range []string{
+				`http1_requests_total{method="POST",code="2xx"} 1`,
+				`http1_requests_total{method="HEAD",code="2xx"} 1`,
+				`http1_requests_total{method="OTHER",code="2xx"} 1`,
+				`http1_request_body_bytes_bucket{le="0"} 3`,
+				`http1_request_body_bytes_bucket{le="64"} 4`,
+				`http1_request_body_bytes_sum 3`,
+				`http1_response_body_bytes_count 4`,
+				`http1_request_duration_seconds_bucket{le="+Inf"} 4`,
+				`http1_connections_active 1`,
+				`http1_connections_total 4`,
+				`http1_keepalive_requests_total 1`,
+				`http1_expect_continue_total{result="continue"} 1`,
+				`http1_parse_errors_total{type="unsupported_transfer_encoding"} 1`,
+				`http1_parse_errors_total{type="malformed"} 0`,
+				`# TYPE http1_request_duration_seconds histogram`,
+				`http1_pool_gets_total{pool="request_body",result="hit"} `,
+				`http1_pool_gets_total{pool="response_body",result="miss"} `,
+			} {
+				if !strings.Contains(text, line) {
+					t.Errorf("missing %q in\n%s", line, text)
+				}
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 2})
+	for _, v := range []float64{0.5, 1, 1.5, 3, 0.25} {
+		h.observe(v)
+	}
+	want := "# HELP h help\n# TYPE h histogram\n" +
+		"h_bucket{le=\"1\"} 3\nh_bucket{le=\"2\"} 4\nh_bucket{le=\"+Inf\"} 5\nh_sum 6.25\nh_count 5\n"
+	if got := string(h.appendText(nil, "h", "help")); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var p bufferPool
+	b := p.Get()
+	if p.hits != 0 || p.misses != 1 {
+		t.Fatalf("empty pool: %d hits %d misses", p.hits, p.misses)
+	}
+	b.WriteString("x")
+	p.Put(b)
+	//sync.Pool may drop what it is given, only a reused buffer must be empty and counted
+	if b = p.Get(); p.hits+p.misses != 2 || len(b.B) != 0 {
+		t.Errorf("%d hits %d misses, buffer %q", p.hits, p.misses, b.B)
+	}
+	p.Put(&bytebufferpool.ByteBuffer{B: make([]byte, 0, maxPooledBufferSize+1)})
+	if b = p.Get(); cap(b.B) > maxPooledBufferSize {
+		t.Error("oversized buffer pooled")
+	}
+}
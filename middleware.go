@@ -0,0 +1,12 @@
+package http1
+
+// Middleware wraps a handler with behaviour that runs around it
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Chain wraps h with m, the first middleware is the outermost
+func Chain(h HandlerFunc, m ...Middleware) HandlerFunc {
+	for i := len(m) - 1; i >= 0; i-- {
+		h = m[i](h)
+	}
+	return h
+}
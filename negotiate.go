@@ -0,0 +1,197 @@
+package http1
+
+import (
+	"bytes"
+)
+
+// Negotiate returns the offered media type the Accept header prefers, or "" when
+// none is acceptable. The most specific matching range gives an offer its q-value,
+// ties go to the earlier offer. Media type parameters other than q are ignored.
+// Without an Accept header the first offer is returned
+func (ctx *Context) Negotiate(offers ...string) string {
+	return negotiate(ctx.req.header.GetHeader(HeaderAccept), offers, matchMediaRange)
+}
+
+// NegotiateLanguage returns the offered language tag Accept-Language prefers,
+// ranges match by prefix as in RFC 4647 basic filtering so "en" accepts "en-US"
+func (ctx *Context) NegotiateLanguage(offers ...string) string {
+	return negotiate(ctx.req.header.GetHeader(HeaderAcceptLanguage), offers, matchLanguageRange)
+}
+
+// NegotiateCharset returns the offered charset Accept-Charset prefers
+func (ctx *Context) NegotiateCharset(offers ...string) string {
+	return negotiate(ctx.req.header.GetHeader(HeaderAcceptCharset), offers, matchCharset)
+}
+
+// NegotiateOr406 negotiates offers against header, one of Accept, Accept-Language or
+// Accept-Charset, and adds header to Vary. When no offer is acceptable it answers
+// 406 Not Acceptable and returns false
+func (ctx *Context) NegotiateOr406(header string, offers ...string) (string, bool) {
+	var best string
+	switch {
+	case equalFoldString(header, HeaderAcceptLanguage):
+		best = ctx.NegotiateLanguage(offers...)
+	case equalFoldString(header, HeaderAcceptCharset):
+		best = ctx.NegotiateCharset(offers...)
+	default:
+		header = HeaderAccept
+		best = ctx.Negotiate(offers...)
+	}
+	ctx.resp.header.AddVary(header)
+	if best == "" {
+		ctx.resp.SetStatusCode(StatusNotAcceptable)
+		ctx.resp.SetBody(s2b(reason(StatusNotAcceptable)))
+		return "", false
+	}
+	return best, true
+}
+
+// AddVary adds name to the Vary header unless it is already listed
+func (h *ResponseHeader) AddVary(name string) {
+	for i := range h.headers {
+		f := &h.headers[i]
+		if !equalFoldString(HeaderVary, b2s(f.key)) {
+			continue
+		}
+		found := false
+		eachListItem(f.value, func(v []byte) bool {
+			found = bytes.Equal(v, byteAsterisk) || equalFoldString(name, b2s(v))
+			return !found
+		})
+		if found {
+			return
+		}
+		f.value = append(append(f.value, byteCommaSpace...), name...)
+		return
+	}
+	h.add(HeaderVary, s2b(name))
+}
+
+// negotiate picks the offer with the highest q-value, match returns the
+// specificity of a range for an offer or -1 when the range doesn't apply
+func negotiate(accept []byte, offers []string, match func(rng []byte, offer string) int) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if len(bytes.TrimSpace(accept)) == 0 {
+		return offers[0]
+	}
+	best, bestQ := "", 0
+	for _, offer := range offers {
+		q, spec := 0, -1
+		eachListItem(accept, func(v []byte) bool {
+			rng, params := v, HeaderParams(nil)
+			if i := bytes.IndexByte(v, ';'); i >= 0 {
+				rng, params = bytes.TrimSpace(v[:i]), HeaderParams(v[i+1:])
+			}
+			s := match(rng, offer)
+			if s <= spec {
+				return true
+			}
+			rq, ok := parseQValue(params.Get("q"))
+			if !ok {
+				return true
+			}
+			q, spec = rq, s
+			return true
+		})
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// parseQValue returns q in thousandths, an absent value is 1
+func parseQValue(v []byte) (int, bool) {
+	if v == nil {
+		return 1000, true
+	}
+	if len(v) == 0 || len(v) > 5 || (v[0] != '0' && v[0] != '1') {
+		return 0, false
+	}
+	q := int(v[0]-'0') * 1000
+	if len(v) == 1 {
+		return q, true
+	}
+	if v[1] != '.' {
+		return 0, false
+	}
+	scale := 100
+	for _, c := range v[2:] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		q += int(c-'0') * scale
+		scale /= 10
+	}
+	if q > 1000 {
+		return 0, false
+	}
+	return q, true
+}
+
+func matchMediaRange(rng []byte, offer string) int {
+	if i := bytes.IndexByte(s2b(offer), ';'); i >= 0 {
+		offer = offer[:i]
+	}
+	slash := bytes.IndexByte(rng, '/')
+	if slash < 0 {
+		return -1
+	}
+	typ, sub := rng[:slash], rng[slash+1:]
+	if bytes.Equal(typ, byteAsterisk) && bytes.Equal(sub, byteAsterisk) {
+		return 0
+	}
+	o := bytes.IndexByte(s2b(offer), '/')
+	if o < 0 || !equalFoldString(offer[:o], b2s(typ)) {
+		return -1
+	}
+	if bytes.Equal(sub, byteAsterisk) {
+		return 1
+	}
+	if equalFoldString(offer[o+1:], b2s(sub)) {
+		return 2
+	}
+	return -1
+}
+
+func matchLanguageRange(rng []byte, offer string) int {
+	if bytes.Equal(rng, byteAsterisk) {
+		return 0
+	}
+	if len(rng) > len(offer) || !equalFoldString(offer[:len(rng)], b2s(rng)) {
+		return -1
+	}
+	if len(rng) < len(offer) && offer[len(rng)] != '-' {
+		return -1
+	}
+	return len(rng)
+}
+
+func matchCharset(rng []byte, offer string) int {
+	if bytes.Equal(rng, byteAsterisk) {
+		return 0
+	}
+	if equalFoldString(offer, b2s(rng)) {
+		return 1
+	}
+	return -1
+}
+
+// eachListItem calls f with every trimmed, non-empty element of a comma separated
+// header value until f returns false
+func eachListItem(v []byte, f func(item []byte) bool) {
+	for len(v) > 0 {
+		var item []byte
+		if i := bytes.IndexByte(v, ','); i >= 0 {
+			item, v = v[:i], v[i+1:]
+		} else {
+			item, v = v, nil
+		}
+		item = bytes.TrimSpace(item)
+		if len(item) > 0 && !f(item) {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package http1
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	media := []string{"application/json", "text/html"}
+	tests := []struct {
+		name   string
+		accept string
+		offers []string
+		match  func(rng []byte, offer string) int
+		want   string
+	}{
+		{"no header", "", media, matchMediaRange, "application/json"},
+		{"no offers", "text/html", nil, matchMediaRange, ""},
+		{"q-values", "text/*;q=0.9, application/json;q=0.5, */*;q=0.1", media, matchMediaRange, "text/html"},
+		{"specific range wins", "text/html;q=0, text/*", media, matchMediaRange, ""},
+		{"subtype wildcard", "text/html;q=0, application/*", media, matchMediaRange, "application/json"},
+		{"tie goes to first offer", "*/*", media, matchMediaRange, "application/json"},
+		{"case insensitive", "TEXT/HTML", media, matchMediaRange, "text/html"},
+		{"offer parameters", "text/html", []string{"text/html; charset=utf-8"}, matchMediaRange, "text/html; charset=utf-8"},
+		{"invalid q ignored", "text/html;q=2, application/json;q=0.1", media, matchMediaRange, "application/json"},
+		{"no match", "image/png", media, matchMediaRange, ""},
+		{"language prefix", "fr;q=0.8, en", []string{"en-US", "fr"}, matchLanguageRange, "en-US"},
+		{"language not a prefix", "e", []string{"en"}, matchLanguageRange, ""},
+		{"language wildcard", "de, *;q=0.1", []string{"fr"}, matchLanguageRange, "fr"},
+		{"charset", "iso-8859-1;q=0.5, *;q=0.2", []string{"utf-8", "iso-8859-1"}, matchCharset, "iso-8859-1"},
+		{"charset refused", "utf-8;q=0", []string{"utf-8"}, matchCharset, ""},
+	}
+	for _, tt := range tests {
+		if got := negotiate([]byte(tt.accept), tt.offers, tt.match); got != tt.want {
+			t.Errorf("%s: negotiate(%q) = %q, want %q", tt.name, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestParseQValue(t *testing.T) {
+	tests := []struct {
+		v  string
+		q  int
+		ok bool
+	}{
+		{"1", 1000, true},
+		{"1.000", 1000, true},
+		{"0.5", 500, true},
+		{"0.125", 125, true},
+		{"0", 0, true},
+		{"1.1", 0, false},
+		{"0.1234", 0, false},
+		{"2", 0, false},
+		{"", 0, false},
+		{".5", 0, false},
+		{"0.x", 0, false},
+	}
+	for _, tt := range tests {
+		if q, ok := parseQValue([]byte(tt.v)); q != tt.q || ok != tt.ok {
+			t.Errorf("parseQValue(%q) = %d, %v", tt.v, q, ok)
+		}
+	}
+	if q, ok := parseQValue(nil); q != 1000 || !ok {
+		t.Errorf("absent q = %d, %v", q, ok)
+	}
+}
+
+func TestNegotiateOr406(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		raw    string
+		status int
+		vary   string
+		body   string
+	}{
+		{"accept", HeaderAccept, "Accept: application/*\r\n", StatusOK, "Origin, Accept", "application/json"},
+		{"not acceptable", HeaderAccept, "Accept: image/png\r\n", StatusNotAcceptable, "Origin, Accept", ""},
+		{"language", "accept-language", "Accept-Language: fr\r\n", StatusOK, "Origin, accept-language, accept", "fr"},
+		{"charset", HeaderAcceptCharset, "Accept-Charset: utf-8;q=0\r\n", StatusNotAcceptable, "Origin, Accept-Charset, accept", ""},
+		{"unknown header", "X-Other", "", StatusOK, "Origin, Accept", "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(func(ctx *Context) {
+				ctx.Response().Header().AddVary("Origin")
+				if best, ok := ctx.NegotiateOr406(tt.header, "application/json", "fr", "iso-8859-1"); ok {
+					ctx.Response().SetBody([]byte(best))
+				}
+				ctx.Response().Header().AddVary("accept")
+			}, 0)
+			out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n"+tt.raw+"\r\n")
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status || resp.Header.Get(HeaderVary) != tt.vary {
+				t.Errorf("status %d Vary %q", resp.StatusCode, resp.Header.Get(HeaderVary))
+			}
+			if body := readBody(resp); tt.body != "" && body != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
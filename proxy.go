@@ -0,0 +1,710 @@
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/widaT/httparse"
+)
+
+const (
+	defaultProxyDialTimeout = 3 * time.Second
+	defaultProxyTimeout     = 30 * time.Second
+	defaultProxyIdleTimeout = 60 * time.Second
+	defaultProxyMaxIdle     = 16
+)
+
+var defaultVia = []byte("http1")
+
+// hopHeaders are removed when a message is forwarded, RFC 9110 7.6.1
+var hopHeaders = []string{
+	HeaderConnection,
+	HeaderKeepAlive,
+	"Proxy-Connection",
+	HeaderProxyAuthenticate,
+	HeaderProxyAuthorization,
+	HeaderTE,
+	HeaderTrailer,
+	HeaderTransferEncoding,
+	HeaderUpgrade,
+}
+
+// ReverseProxy is a handler forwarding requests to upstream servers over
+// pooled keep-alive connections. Upstream responses are streamed to the client.
+// With HeaderHandler installed, request bodies are streamed to the upstream as
+// they arrive, otherwise they are sent from the buffer the server read them into.
+// Upstream failures are answered with 502, timeouts with 504.
+type ReverseProxy struct {
+	//Addr is the host:port of the upstream
+	Addr string
+	//Upstream picks the upstream host:port per request, Addr is used when it is nil
+	Upstream func(ctx *Context) string
+	//Via is the pseudonym added to the Via header
+	Via []byte
+
+	DialTimeout time.Duration
+	//Timeout bounds each write to and read from the upstream
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	//MaxIdleConnsPerHost is the number of idle connections kept per upstream
+	MaxIdleConnsPerHost int
+
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn
+}
+
+func NewReverseProxy(addr string) *ReverseProxy {
+	return &ReverseProxy{
+		Addr:                addr,
+		Via:                 defaultVia,
+		DialTimeout:         defaultProxyDialTimeout,
+		Timeout:             defaultProxyTimeout,
+		IdleTimeout:         defaultProxyIdleTimeout,
+		MaxIdleConnsPerHost: defaultProxyMaxIdle,
+	}
+}
+
+type upstreamConn struct {
+	net.Conn
+	addr   string
+	br     *bufio.Reader
+	bw     *bufio.Writer
+	header []byte //raw response header, the parsed fields point into it
+	via    []byte
+	resp   httparse.Response
+	used   time.Time
+	//written counts the bytes of the current request that reached the connection
+	written int
+}
+
+func (uc *upstreamConn) Write(p []byte) (int, error) {
+	n, err := uc.Conn.Write(p)
+	uc.written += n
+	return n, err
+}
+
+// HeaderHandler starts forwarding a request whose body hasn't fully arrived, the body
+// is then written to the upstream as it is received instead of being read into memory.
+// Install it as Server.HeaderHandler next to Handler. A streamed body can't be sent
+// twice, so it always goes out on a new connection
+func (p *ReverseProxy) HeaderHandler(ctx *Context) bool {
+	req := ctx.req
+	length := req.header.ContentLength
+	if length != -1 && (length <= 0 || ctx.conn.Buffered() >= length ||
+		(req.MaxBodySize > 0 && length > req.MaxBodySize)) {
+		//Handler sends the buffered body and may retry it on another connection
+		return true
+	}
+	uc, _, err := p.conn(p.addr(ctx), true)
+	if err != nil {
+		p.fail(ctx, err)
+		return false
+	}
+	p.deadline(uc)
+	uc.written = 0
+	p.writeRequest(ctx, uc.bw, true)
+	req.streamTo(&upstreamRequestBody{proxy: p, conn: uc, chunked: length == -1})
+	return true
+}
+
+func (p *ReverseProxy) addr(ctx *Context) string {
+	if p.Upstream != nil {
+		return p.Upstream(ctx)
+	}
+	return p.Addr
+}
+
+func (p *ReverseProxy) Handler(ctx *Context) {
+	if body, ok := ctx.req.sink.(*upstreamRequestBody); ok {
+		p.forwardStreamed(ctx, body)
+		return
+	}
+	addr := p.addr(ctx)
+	var (
+		uc     *upstreamConn
+		reused bool
+		err    error
+	)
+	//a pooled connection may have been closed by the upstream, retry once on a new one
+	for attempt := 0; attempt < 2; attempt++ {
+		uc, reused, err = p.conn(addr, attempt > 0)
+		if err != nil {
+			break
+		}
+		if err = p.roundTrip(ctx, uc); err == nil {
+			break
+		}
+		uc.Close()
+		if !reused || !p.retryable(ctx, uc, err) {
+			break
+		}
+	}
+	if err != nil {
+		p.fail(ctx, err)
+		return
+	}
+	p.forwardResponse(ctx, uc)
+}
+
+// forwardStreamed reads the response to a request whose body HeaderHandler streamed
+func (p *ReverseProxy) forwardStreamed(ctx *Context, body *upstreamRequestBody) {
+	uc := body.conn
+	//the connection now belongs to the response
+	body.conn = nil
+	err := body.err
+	if err == nil {
+		p.deadline(uc)
+		err = readResponseHeader(uc)
+	}
+	if err != nil {
+		uc.Close()
+		p.fail(ctx, err)
+		return
+	}
+	p.forwardResponse(ctx, uc)
+}
+
+// roundTrip sends the request and reads the response header
+func (p *ReverseProxy) roundTrip(ctx *Context, uc *upstreamConn) error {
+	p.deadline(uc)
+	uc.written = 0
+	p.writeRequest(ctx, uc.bw, false)
+	if err := uc.bw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return readResponseHeader(uc)
+}
+
+// readResponseHeader reads up to the final response header
+func readResponseHeader(uc *upstreamConn) error {
+	for {
+		if err := uc.readHeader(); err != nil {
+			return err
+		}
+		//interim responses are not forwarded, the body was already received
+		if uc.resp.StatusCode >= 200 || uc.resp.StatusCode == StatusSwitchingProtocols {
+			return nil
+		}
+	}
+}
+
+// writeRequest writes the request head and the buffered body, a streamed body
+// only gets its framing
+func (p *ReverseProxy) writeRequest(ctx *Context, w *bufio.Writer, streamed bool) {
+	req := &ctx.req.header
+	uri := &ctx.req.uri
+	w.Write(p.method(ctx))
+	w.WriteByte(' ')
+	switch {
+	case uri.IsAsterisk() || uri.IsAuthority():
+		w.Write(req.URI)
+	default:
+		w.Write(uri.PathOriginal())
+		if len(uri.QueryString()) > 0 {
+			w.WriteByte('?')
+			w.Write(uri.QueryString())
+		}
+	}
+	w.WriteByte(' ')
+	w.Write(byteHTTP11)
+	w.Write(byteCRLF)
+
+	//an absolute-form target replaces the Host header, RFC 9112 3.2.2
+	absolute := len(req.URI) > 0 && req.URI[0] != '/' && !uri.IsAsterisk() && !uri.IsAuthority()
+	if absolute {
+		writeLine(w, byteHost, uri.Host())
+	}
+	connection := req.GetHeader(HeaderConnection)
+	//every line is forwarded in the order it was received, repeated fields included
+	visitHeaderLines(req.raw, func(k, v []byte) {
+		key := b2s(k)
+		if isHopHeader(key, connection) || equalFoldString(key, HeaderContentLength) ||
+			equalFoldString(key, HeaderExpect) || equalFoldString(key, HeaderVia) ||
+			equalFoldString(key, HeaderXForwardedFor) || (absolute && equalFoldString(key, HeaderHost)) {
+			return
+		}
+		writeLine(w, k, v)
+	})
+
+	w.Write(byteVia)
+	w.Write(byteColonSpace)
+	writeVia(w, req.GetHeader(HeaderVia), req.Proto, p.via())
+	w.Write(byteCRLF)
+
+	w.Write(byteXForwardedFor)
+	w.Write(byteColonSpace)
+	//every line the client or earlier proxies sent is kept, in order
+	req.VisitValues(HeaderXForwardedFor, func(prior []byte) {
+		if len(prior) > 0 {
+			w.Write(prior)
+			w.Write(byteCommaSpace)
+		}
+	})
+	w.WriteString(remoteIP(ctx.RemoteAddr()))
+	w.Write(byteCRLF)
+	if len(req.GetHeader(HeaderXForwardedHost)) == 0 && len(req.Host) > 0 {
+		writeLine(w, byteXForwardedHost, req.Host)
+	}
+	if len(req.GetHeader(HeaderXForwardedProto)) == 0 {
+		writeLine(w, byteXForwardedProto, uri.Scheme())
+	}
+
+	if streamed {
+		if req.ContentLength == -1 {
+			writeLine(w, byteTransferEncoding, byteChunked)
+		} else {
+			writeLine(w, byteContentLength, s2b(strconv.Itoa(req.ContentLength)))
+		}
+		w.Write(byteCRLF)
+		return
+	}
+	body := ctx.req.Body()
+	if len(body) > 0 || req.ContentLength != 0 {
+		writeLine(w, byteContentLength, s2b(strconv.Itoa(len(body))))
+	}
+	w.Write(byteCRLF)
+	w.Write(body)
+}
+
+// forwardResponse copies the upstream status and headers and streams the body,
+// uc goes back to the pool once the body is read to the end
+func (p *ReverseProxy) forwardResponse(ctx *Context, uc *upstreamConn) {
+	resp := &uc.resp
+	ctx.resp.SetStatusCode(resp.StatusCode)
+	ctx.resp.header.ContentType = nil
+
+	te, err := fixTransferEncoding(resp.Headers)
+	if err != nil {
+		uc.Close()
+		p.fail(ctx, err)
+		return
+	}
+	method := p.method(ctx)
+	length, err := fixLength(true, resp.StatusCode, method, resp.Headers, te)
+	if err != nil {
+		uc.Close()
+		p.fail(ctx, err)
+		return
+	}
+	//a HEAD response has no body but keeps the length of the body it describes
+	headLength := -1
+	if bytes.Equal(method, byteHead) {
+		if length >= 0 {
+			headLength = length
+		}
+		length = 0
+	}
+
+	keepAlive := bytes.Equal(resp.Proto, byteHTTP11) &&
+		!bytes.EqualFold(resp.GetHeader(HeaderConnection), byteClose) && length != -2
+	connection := resp.GetHeader(HeaderConnection)
+	//repeated fields such as Set-Cookie keep every line and their order
+	visitHeaderLines(uc.header, func(k, v []byte) {
+		key := b2s(k)
+		if isHopHeader(key, connection) || equalFoldString(key, HeaderContentLength) ||
+			equalFoldString(key, HeaderDate) || equalFoldString(key, HeaderVia) {
+			return
+		}
+		ctx.resp.header.Add(key, v)
+	})
+	uc.via = appendVia(uc.via[:0], resp.GetHeader(HeaderVia), resp.Proto, p.via())
+	ctx.resp.header.Add(HeaderVia, uc.via)
+
+	body := &upstreamBody{proxy: p, conn: uc, keepAlive: keepAlive}
+	switch {
+	case length == 0:
+		body.r = eofReader{}
+		if headLength >= 0 {
+			ctx.resp.SetBodyStream(body, headLength)
+		} else {
+			ctx.resp.SetBodyStream(body, 0)
+		}
+		return
+	case length > 0:
+		body.r = &io.LimitedReader{R: uc.br, N: int64(length)}
+		ctx.resp.SetBodyStream(body, length)
+	case length == -1:
+		body.r = newChunkedReader(uc.br)
+		ctx.resp.SetBodyStream(body, -1)
+	default:
+		body.r = uc.br
+		ctx.resp.SetBodyStream(body, -1)
+	}
+}
+
+func (p *ReverseProxy) fail(ctx *Context, err error) {
+	ctx.resp.header.Reset()
+	if ne, ok := errors.Cause(err).(net.Error); ok && ne.Timeout() {
+		ctx.resp.SetStatusCode(StatusGatewayTimeout)
+	} else {
+		ctx.resp.SetStatusCode(StatusBadGateway)
+	}
+	ctx.resp.SetBody(s2b(reason(ctx.resp.header.StatusCode)))
+}
+
+// method is the method sent upstream, HEAD stays HEAD when Server.HeadAsGet rewrote it
+func (p *ReverseProxy) method(ctx *Context) []byte {
+	if ctx.head {
+		return byteHead
+	}
+	return ctx.req.header.Method
+}
+
+// retryable reports whether a request that failed on a pooled connection may be sent
+// again: nothing of it reached the upstream, or the upstream closed the idle connection
+// and the method is idempotent. A request that may have been processed with side
+// effects is never sent twice
+func (p *ReverseProxy) retryable(ctx *Context, uc *upstreamConn, err error) bool {
+	cause := errors.Cause(err)
+	if ne, ok := cause.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	if uc.written == 0 {
+		return true
+	}
+	if cause != io.EOF && cause != io.ErrUnexpectedEOF {
+		if _, ok := cause.(*net.OpError); !ok {
+			return false
+		}
+	}
+	switch b2s(p.method(ctx)) {
+	case MethodGet, MethodHead, MethodOptions, MethodTrace, MethodPut, MethodDelete:
+		return true
+	}
+	return false
+}
+
+func (p *ReverseProxy) via() []byte {
+	if len(p.Via) > 0 {
+		return p.Via
+	}
+	return defaultVia
+}
+
+func (p *ReverseProxy) deadline(uc *upstreamConn) {
+	if p.Timeout > 0 {
+		uc.SetDeadline(time.Now().Add(p.Timeout))
+	}
+}
+
+// conn returns an idle connection to addr or dials a new one
+func (p *ReverseProxy) conn(addr string, fresh bool) (*upstreamConn, bool, error) {
+	if !fresh {
+		if uc := p.takeIdle(addr); uc != nil {
+			return uc, true, nil
+		}
+	}
+	c, err := net.DialTimeout("tcp", addr, p.DialTimeout)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	uc := &upstreamConn{
+		Conn: c,
+		addr: addr,
+		br:   bufio.NewReaderSize(c, 4096),
+	}
+	uc.bw = bufio.NewWriterSize(uc, 4096)
+	return uc, false, nil
+}
+
+func (p *ReverseProxy) takeIdle(addr string) *upstreamConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[addr]
+	for len(conns) > 0 {
+		uc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		p.idle[addr] = conns
+		if p.IdleTimeout > 0 && time.Since(uc.used) > p.IdleTimeout {
+			uc.Close()
+			continue
+		}
+		return uc
+	}
+	return nil
+}
+
+func (p *ReverseProxy) putIdle(uc *upstreamConn) {
+	uc.used = time.Now()
+	uc.SetDeadline(time.Time{})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*upstreamConn)
+	}
+	max := p.MaxIdleConnsPerHost
+	if max <= 0 {
+		max = defaultProxyMaxIdle
+	}
+	if len(p.idle[uc.addr]) >= max {
+		uc.Close()
+		return
+	}
+	p.idle[uc.addr] = append(p.idle[uc.addr], uc)
+}
+
+// CloseIdleConnections closes the pooled upstream connections
+func (p *ReverseProxy) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.idle {
+		for _, uc := range conns {
+			uc.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
+
+// readHeader reads the status line and headers into uc.header and parses them
+func (uc *upstreamConn) readHeader() error {
+	uc.header = uc.header[:0]
+	for {
+		line, err := uc.br.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				err = ErrHeaderTooLarge
+			}
+			return errors.WithStack(err)
+		}
+		uc.header = append(uc.header, line...)
+		if len(uc.header) > maxHeaderSize {
+			return errors.WithStack(ErrHeaderTooLarge)
+		}
+		if len(uc.header) > len(line) && len(trimTrailingWhitespace(line)) == 0 {
+			break
+		}
+	}
+	uc.resp.Reset()
+	if _, err := uc.resp.Parse(uc.header); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// upstreamBody streams a response body from an upstream connection,
+// Close puts the connection back into the pool when the body was read completely
+type upstreamBody struct {
+	proxy     *ReverseProxy
+	conn      *upstreamConn
+	r         io.Reader
+	keepAlive bool
+	done      bool
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	b.proxy.deadline(b.conn)
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		if lr, ok := b.r.(*io.LimitedReader); ok && lr.N > 0 {
+			//the upstream closed before sending the announced length
+			return n, io.ErrUnexpectedEOF
+		}
+		b.done = true
+	}
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	if b.conn == nil {
+		return nil
+	}
+	if lr, ok := b.r.(*io.LimitedReader); ok && lr.N == 0 {
+		b.done = true
+	}
+	if _, ok := b.r.(eofReader); ok {
+		b.done = true
+	}
+	if b.done && b.keepAlive {
+		b.proxy.putIdle(b.conn)
+	} else {
+		b.conn.Close()
+	}
+	b.conn = nil
+	return nil
+}
+
+// upstreamRequestBody writes a request body to the upstream as the client sends it,
+// a chunked body is forwarded chunked. The first write error is kept for Handler
+type upstreamRequestBody struct {
+	proxy   *ReverseProxy
+	conn    *upstreamConn
+	chunked bool
+	err     error
+}
+
+func (b *upstreamRequestBody) writeBody(p []byte) {
+	if b.err != nil {
+		return
+	}
+	b.proxy.deadline(b.conn)
+	if b.chunked {
+		cw := chunkWriter{w: b.conn.bw}
+		cw.Write(p)
+	} else {
+		b.conn.bw.Write(p)
+	}
+	b.err = errors.WithStack(b.conn.bw.Flush())
+}
+
+func (b *upstreamRequestBody) endBody() {
+	if b.err != nil {
+		return
+	}
+	if b.chunked {
+		b.conn.bw.Write(byteLastChunk)
+	}
+	b.err = errors.WithStack(b.conn.bw.Flush())
+}
+
+// Close closes the upstream connection unless Handler took it for the response
+func (b *upstreamRequestBody) Close() error {
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func isHopHeader(key string, connection []byte) bool {
+	for _, h := range hopHeaders {
+		if equalFoldString(key, h) {
+			return true
+		}
+	}
+	//fields listed in Connection are hop-by-hop as well
+	for len(connection) > 0 {
+		var token []byte
+		if i := bytes.IndexByte(connection, ','); i >= 0 {
+			token, connection = connection[:i], connection[i+1:]
+		} else {
+			token, connection = connection, nil
+		}
+		if equalFoldString(b2s(bytes.TrimSpace(token)), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendVia appends the Via value for a message received with proto
+func appendVia(dst, prior, proto, pseudonym []byte) []byte {
+	if len(prior) > 0 {
+		dst = append(dst, prior...)
+		dst = append(dst, byteCommaSpace...)
+	}
+	dst = append(dst, bytes.TrimPrefix(proto, byteHTTPSlash)...)
+	dst = append(dst, ' ')
+	return append(dst, pseudonym...)
+}
+
+func writeVia(w *bufio.Writer, prior, proto, pseudonym []byte) {
+	if len(prior) > 0 {
+		w.Write(prior)
+		w.Write(byteCommaSpace)
+	}
+	w.Write(bytes.TrimPrefix(proto, byteHTTPSlash))
+	w.WriteByte(' ')
+	w.Write(pseudonym)
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// chunkedReader decodes a chunked body read from r, trailers are discarded
+type chunkedReader struct {
+	r        *bufio.Reader
+	n        int //bytes left in the current chunk
+	checkEnd bool
+	err      error
+}
+
+func newChunkedReader(r *bufio.Reader) *chunkedReader {
+	return &chunkedReader{r: r}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.n == 0 {
+		if cr.checkEnd {
+			if cr.err = cr.readCRLF(); cr.err != nil {
+				return 0, cr.err
+			}
+			cr.checkEnd = false
+		}
+		line, err := cr.r.ReadSlice('\n')
+		if err != nil {
+			cr.err = errors.WithStack(err)
+			return 0, cr.err
+		}
+		size, _, err := parseChunkSize(line, maxLineLength)
+		if err != nil {
+			cr.err = errors.WithStack(err)
+			return 0, cr.err
+		}
+		if size == 0 {
+			cr.err = cr.skipTrailer()
+			return 0, cr.err
+		}
+		cr.n = size
+	}
+	if len(p) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.r.Read(p)
+	cr.n -= n
+	cr.checkEnd = cr.n == 0
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+func (cr *chunkedReader) readCRLF() error {
+	line, err := cr.r.ReadSlice('\n')
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(trimTrailingWhitespace(line)) != 0 {
+		return errors.Errorf("cannot find crlf at the end of chunk")
+	}
+	return nil
+}
+
+// skipTrailer reads up to the empty line ending the trailer section and returns io.EOF
+func (cr *chunkedReader) skipTrailer() error {
+	for {
+		line, err := cr.r.ReadSlice('\n')
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(trimTrailingWhitespace(line)) == 0 {
+			return io.EOF
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package http1
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReverseProxyForwarding(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Up", "1")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "hop")
+		fmt.Fprintf(w, "%s %s host=%s xff=%s xfh=%s xfp=%s via=%s foo=%q te=%q body=%s",
+			r.Method, r.URL, r.Host, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"),
+			r.Header.Get("X-Forwarded-Proto"), r.Header.Get("Via"), r.Header.Get("X-Foo"), r.TransferEncoding, b)
+		if r.URL.Path == "/stream" {
+			w.(http.Flusher).Flush()
+			w.Write([]byte(" more"))
+		}
+	}))
+	defer up.Close()
+	p := NewReverseProxy(up.Listener.Addr().String())
+	defer p.CloseIdleConnections()
+	s := NewServer(p.Handler, 0)
+
+	tests := []struct {
+		name    string
+		raw     string
+		method  string
+		body    string
+		chunked bool
+	}{
+		{"hop headers", "GET /a?b=1 HTTP/1.1\r\nHost: front\r\nConnection: keep-alive, X-Foo\r\nX-Foo: 1\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n", "GET",
+			`GET /a?b=1 host=front xff=1.2.3.4, 10.0.0.1 xfh=front xfp=http via=1.1 http1 foo="" te=[] body=`, false},
+		{"repeated x-forwarded-for", "GET / HTTP/1.1\r\nHost: front\r\nX-Forwarded-For: 1.2.3.4\r\nX-Forwarded-For: 5.6.7.8\r\n\r\n", "GET",
+			`GET / host=front xff=1.2.3.4, 5.6.7.8, 10.0.0.1 xfh=front xfp=http via=1.1 http1 foo="" te=[] body=`, false},
+		{"chunked request", "POST /p HTTP/1.1\r\nHost: front\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", "POST",
+			`POST /p host=front xff=10.0.0.1 xfh=front xfp=http via=1.1 http1 foo="" te=[] body=abc`, false},
+		{"streamed response", "GET /stream HTTP/1.1\r\nHost: front\r\n\r\n", "GET",
+			`GET /stream host=front xff=10.0.0.1 xfh=front xfp=http via=1.1 http1 foo="" te=[] body= more`, true},
+		{"head", "HEAD /a HTTP/1.1\r\nHost: front\r\n\r\n", "HEAD", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := serveString(s, tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := readResponses(t, out, tt.method)[0]
+			if resp.StatusCode != StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if body := readBody(resp); body != tt.body {
+				t.Errorf("body %q\nwant %q", body, tt.body)
+			}
+			if resp.Header.Get("X-Up") != "1" || resp.Header.Get("X-Hop") != "" || resp.Header.Get("Via") != "1.1 http1" {
+				t.Errorf("response headers %v", resp.Header)
+			}
+			if chunked := len(resp.TransferEncoding) > 0; chunked != tt.chunked {
+				t.Errorf("chunked %v, want %v", chunked, tt.chunked)
+			}
+		})
+	}
+	if n := len(p.idle[p.Addr]); n != 1 {
+		t.Errorf("%d idle upstream connections, want 1", n)
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				switch r.URL.Path {
+				case "/slow":
+					time.Sleep(200 * time.Millisecond)
+				case "/truncated":
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc"))
+				}
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		addr   string
+		path   string
+		status int
+	}{
+		{"refused", "127.0.0.1:1", "/", StatusBadGateway},
+		{"closed", ln.Addr().String(), "/", StatusBadGateway},
+		{"timeout", ln.Addr().String(), "/slow", StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewReverseProxy(tt.addr)
+			p.Timeout = 50 * time.Millisecond
+			out, _ := serveString(NewServer(p.Handler, 0), "GET "+tt.path+" HTTP/1.1\r\nHost: a\r\n\r\n")
+			if resp := readResponses(t, out, "GET")[0]; resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	//a body cut short by the upstream closes the client connection and the upstream one
+	p := NewReverseProxy(ln.Addr().String())
+	c := newTestConn("GET /truncated HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	ctx := AcquireContext(NewServer(p.Handler, 0), c)
+	if err := serveConn(ctx, c); err == nil {
+		t.Error("truncated upstream body didn't close the connection")
+	}
+	if ctx.resp.bodyStream != nil {
+		t.Error("body stream still open after the failed write")
+	}
+	ReleaseContext(ctx)
+	if out := c.output(); strings.Count(out, "HTTP/1.1") != 1 || !strings.HasSuffix(out, "abc") {
+		t.Errorf("output %q", out)
+	}
+	if n := len(p.idle[p.Addr]); n != 0 {
+		t.Errorf("%d idle upstream connections after a failed body", n)
+	}
+}
+
+// TestReverseProxyRetry sends a request over a pooled connection the upstream has
+// closed, only idempotent requests may be sent again
+func TestReverseProxyRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var requests int32
+	closed := make(chan struct{}, 4)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err == nil {
+					atomic.AddInt32(&requests, 1)
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				}
+				//the connection looks reusable but is closed after one request
+				c.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	tests := []struct {
+		method   string
+		status   int
+		requests int32
+	}{
+		{MethodGet, StatusOK, 2},
+		{MethodPut, StatusOK, 2},
+		{MethodPost, StatusBadGateway, 1},
+		{MethodPatch, StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			p := NewReverseProxy(ln.Addr().String())
+			defer p.CloseIdleConnections()
+			s := NewServer(p.Handler, 0)
+			atomic.StoreInt32(&requests, 0)
+			raw := tt.method + " / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\n\r\nx"
+			out, _ := serveString(s, raw)
+			if resp := readResponses(t, out, tt.method)[0]; resp.StatusCode != StatusOK {
+				t.Fatalf("first request status %d", resp.StatusCode)
+			}
+			<-closed
+			out, _ = serveString(s, raw)
+			if resp := readResponses(t, out, tt.method)[0]; resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if n := atomic.LoadInt32(&requests); n != tt.requests {
+				t.Errorf("upstream got %d requests, want %d", n, tt.requests)
+			}
+			if tt.requests == 2 {
+				<-closed
+			}
+		})
+	}
+}
+
+// rawUpstream serves every connection with serve until the test ends
+func rawUpstream(t *testing.T, serve func(c net.Conn, br *bufio.Reader)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c, bufio.NewReader(c))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestReverseProxyHeaderOrder(t *testing.T) {
+	//the upstream answers with the field lines it received, in order
+	addr := rawUpstream(t, func(c net.Conn, br *bufio.Reader) {
+		var lines []string
+		br.ReadString('\n')
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			if !strings.HasPrefix(line, "Via:") && !strings.HasPrefix(line, "X-Forwarded-") {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+		}
+		body := strings.Join(lines, "|")
+		fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nSet-Cookie: a=1\r\nX-Up: 1\r\nset-cookie: b=2\r\nSet-Cookie: c=3\r\n"+
+			"Connection: close\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	})
+	p := NewReverseProxy(addr)
+	out, err := serveString(NewServer(p.Handler, 0), "GET / HTTP/1.1\r\nHost: front\r\nX-B: 1\r\nX-A: 2\r\n"+
+		"X-B: 3\r\nCookie: a=1\r\nConnection: X-Hop\r\nX-Hop: 1\r\nCookie: b=2\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := readResponses(t, out, "GET")[0]
+	if body, want := readBody(resp), "Host: front|X-B: 1|X-A: 2|X-B: 3|Cookie: a=1|Cookie: b=2"; body != want {
+		t.Errorf("upstream got %q, want %q", body, want)
+	}
+	if cookies := resp.Header["Set-Cookie"]; strings.Join(cookies, " ") != "a=1 b=2 c=3" {
+		t.Errorf("Set-Cookie %q", cookies)
+	}
+	if i, j := strings.Index(out, "Set-Cookie: a=1"), strings.Index(out, "X-Up: 1"); i < 0 || j < i {
+		t.Errorf("response fields reordered: %q", out)
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		body string
+		err  bool
+	}{
+		{"chunks", "3\r\nabc\r\n2;x=1\r\nde\r\n0\r\nT: 1\r\n\r\n", "abcde", false},
+		{"sign bit", "8000000000000000\r\nabc\r\n0\r\n\r\n", "", true},
+		{"all ones", "ffffffffffffffff\r\nabc\r\n0\r\n\r\n", "", true},
+		{"bad size", "x\r\nabc\r\n0\r\n\r\n", "", true},
+		{"missing crlf", "3\r\nabcd\r\n0\r\n\r\n", "abc", true},
+		{"truncated", "5\r\nabc", "abc", true},
+	}
+	for _, tt := range tests {
+		body, err := ioutil.ReadAll(newChunkedReader(bufio.NewReader(strings.NewReader(tt.in))))
+		if string(body) != tt.body || (err != nil) != tt.err {
+			t.Errorf("%s: %q, %v", tt.name, body, err)
+		}
+	}
+}
+
+// TestReverseProxyHostileUpstream makes sure a broken upstream response ends the client
+// connection instead of crashing the server
+func TestReverseProxyHostileUpstream(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+	}{
+		{"chunk size overflow", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8000000000000000\r\nabc\r\n0\r\n\r\n"},
+		{"chunk size all ones", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\nffffffffffffffff\r\nabc\r\n0\r\n\r\n"},
+		{"bad chunk size", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := rawUpstream(t, func(c net.Conn, br *bufio.Reader) {
+				if _, err := http.ReadRequest(br); err == nil {
+					c.Write([]byte(tt.resp))
+				}
+			})
+			p := NewReverseProxy(addr)
+			c := newTestConn("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+			ctx := AcquireContext(NewServer(p.Handler, 0), c)
+			if err := serveConn(ctx, c); err == nil {
+				t.Error("broken upstream body didn't close the connection")
+			}
+			ReleaseContext(ctx)
+			if out := c.output(); strings.Count(out, "HTTP/1.1") != 1 {
+				t.Errorf("output %q", out)
+			}
+			if n := len(p.idle[p.Addr]); n != 0 {
+				t.Errorf("%d idle upstream connections after a broken body", n)
+			}
+		})
+	}
+}
+
+func TestReverseProxyStreamedBody(t *testing.T) {
+	//the upstream reports every piece of the body as it reads it
+	got := make(chan string, 16)
+	addr := rawUpstream(t, func(c net.Conn, br *bufio.Reader) {
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		var body []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				body = append(body, buf[:n]...)
+				got <- string(body)
+			}
+			if err != nil {
+				break
+			}
+		}
+		resp := fmt.Sprintf("te=%v cl=%d body=%s", r.TransferEncoding, r.ContentLength, body)
+		fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(resp), resp)
+	})
+	const head = "POST / HTTP/1.1\r\nHost: a\r\n"
+	tests := []struct {
+		name   string
+		parts  []string
+		seen   []string //the body the upstream has after each part but the last, "" when it got nothing new
+		status int
+		body   string
+	}{
+		{"content length", []string{head + "Content-Length: 10\r\n\r\nhello", "world"}, []string{"hello"},
+			StatusOK, "te=[] cl=10 body=helloworld"},
+		{"chunked", []string{head + "Transfer-Encoding: chunked\r\n\r\n5\r\nhel", "lo\r\n5\r\nworld\r\n", "0\r\n\r\n"},
+			[]string{"hel", "helloworld"}, StatusOK, "te=[chunked] cl=-1 body=helloworld"},
+		{"chunked with trailer", []string{head + "Transfer-Encoding: chunked\r\n\r\n3\r\nabc\r", "\n0\r\nT: 1\r\n", "\r\n"},
+			[]string{"abc", ""}, StatusOK, "te=[chunked] cl=-1 body=abc"},
+		{"buffered body", []string{head + "Content-Length: 3\r\n\r\nabc"}, nil, StatusOK, "te=[] cl=3 body=abc"},
+		{"too large", []string{head + "Transfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n", "20\r\n"}, []string{"abc"},
+			StatusRequestEntityTooLarge, "Request Entity Too Large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewReverseProxy(addr)
+			defer p.CloseIdleConnections()
+			s := NewServer(p.Handler, 0)
+			s.HeaderHandler = p.HeaderHandler
+			s.Limits.MaxBodySize = 16
+			c := newTestConn("")
+			ctx := AcquireContext(s, c)
+			defer ReleaseContext(ctx)
+			for i, part := range tt.parts {
+				c.feed(part)
+				serveConn(ctx, c)
+				if i == len(tt.parts)-1 {
+					break
+				}
+				if out := c.output(); out != "" {
+					t.Fatalf("answered before the body was complete: %q", out)
+				}
+				for body := ""; tt.seen[i] != "" && body != tt.seen[i]; {
+					select {
+					case body = <-got:
+					case <-time.After(time.Second):
+						t.Fatalf("upstream has %q after part %d, want %q", body, i, tt.seen[i])
+					}
+				}
+			}
+			resp := readResponses(t, c.output(), "POST")[0]
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if body := readBody(resp); body != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestReverseProxyStreamedBodyErrors(t *testing.T) {
+	s := NewServer(func(ctx *Context) {}, 0)
+	p := NewReverseProxy("127.0.0.1:1")
+	s.Handler, s.HeaderHandler = p.Handler, p.HeaderHandler
+	out, err := serveString(s, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\nabc")
+	if err != errShouldClose {
+		t.Errorf("error %v", err)
+	}
+	if resp := readResponses(t, out, "POST")[0]; resp.StatusCode != StatusBadGateway || !resp.Close {
+		t.Errorf("status %d close %v", resp.StatusCode, resp.Close)
+	}
+
+	//the upstream connection is closed when the client goes away before the body ends
+	closed := make(chan struct{})
+	p = NewReverseProxy(rawUpstream(t, func(c net.Conn, br *bufio.Reader) {
+		ioutil.ReadAll(br)
+		close(closed)
+	}))
+	s.Handler, s.HeaderHandler = p.Handler, p.HeaderHandler
+	serveString(s, "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nab")
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("upstream connection left open")
+	}
+}
@@ -0,0 +1,309 @@
+package http1
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateLimitShards  = 32
+	defaultRateKeys  = 1 << 16
+	defaultRetryWait = time.Second
+)
+
+// RateKeyFunc picks the bucket a request is counted against,
+// the returned slice is only used during the call
+type RateKeyFunc func(ctx *Context) []byte
+
+// KeyByIP counts requests per client address, see Context.RealIP
+func KeyByIP(ctx *Context) []byte {
+	return ctx.RealIP()
+}
+
+// KeyByHeader counts requests per value of the named header,
+// requests without it share one bucket
+func KeyByHeader(name string) RateKeyFunc {
+	return func(ctx *Context) []byte {
+		return ctx.req.header.GetHeader(name)
+	}
+}
+
+// KeyByRoute counts requests per normalized path
+func KeyByRoute(ctx *Context) []byte {
+	return ctx.req.uri.Path()
+}
+
+// RateLimiter is a token bucket per key, a bucket holds Burst tokens and refills
+// at Rate tokens per second. The keyspace is split in shards that each evict their
+// least recently used bucket once MaxKeys is reached.
+// A RateLimiter literal works as well as one made by NewRateLimiter
+type RateLimiter struct {
+	Rate float64
+	//Burst below one allows bursts of one request
+	Burst int
+	//Key is KeyByIP when nil
+	Key RateKeyFunc
+	//MaxKeys bounds the number of buckets kept, <= 0 keeps up to 65536.
+	//It is read once, before the first request is counted
+	MaxKeys int
+
+	once   sync.Once
+	shards [rateLimitShards]rateShard
+}
+
+type rateShard struct {
+	mu sync.Mutex
+	//buckets is indexed by key hash, buckets with the same hash are chained through hnext
+	buckets map[uint64]*rateBucket
+	n       int
+	max     int
+	//head is the most recently used bucket, tail the next one to evict
+	head, tail *rateBucket
+}
+
+type rateBucket struct {
+	//key is copied into a buffer that is kept when the bucket is reused
+	key        []byte
+	hash       uint64
+	tokens     float64
+	last       int64
+	prev, next *rateBucket
+	hnext      *rateBucket
+}
+
+// NewRateLimiter allows rate requests per second and bursts of burst requests
+// per key, maxKeys <= 0 keeps up to 65536 buckets
+func NewRateLimiter(rate float64, burst int, key RateKeyFunc, maxKeys int) *RateLimiter {
+	if maxKeys <= 0 {
+		maxKeys = defaultRateKeys
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l := &RateLimiter{Rate: rate, Burst: burst, Key: key, MaxKeys: maxKeys}
+	l.once.Do(l.init)
+	return l
+}
+
+// init sizes the shards from MaxKeys, it runs once before the first bucket is made
+func (l *RateLimiter) init() {
+	maxKeys := l.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultRateKeys
+	}
+	perShard := (maxKeys + rateLimitShards - 1) / rateLimitShards
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[uint64]*rateBucket, perShard)
+		l.shards[i].max = perShard
+	}
+}
+
+func (l *RateLimiter) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// Allow takes a token from the bucket of key, when it is empty it returns
+// false and how long until the next token
+func (l *RateLimiter) Allow(key []byte) (bool, time.Duration) {
+	return l.allow(key, time.Now().UnixNano())
+}
+
+func (l *RateLimiter) allow(key []byte, now int64) (bool, time.Duration) {
+	l.once.Do(l.init)
+	h := fnv64a(key)
+	sh := &l.shards[h%rateLimitShards]
+	sh.mu.Lock()
+	b := sh.lookup(h, key)
+	if b == nil {
+		b = sh.insert(h, key)
+		b.tokens = l.burst()
+	} else {
+		sh.moveToFront(b)
+		b.tokens += float64(now-b.last) / float64(time.Second) * l.Rate
+		if max := l.burst(); b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		sh.mu.Unlock()
+		return true, 0
+	}
+	missing := 1 - b.tokens
+	sh.mu.Unlock()
+	if l.Rate <= 0 {
+		return false, defaultRetryWait
+	}
+	return false, time.Duration(missing / l.Rate * float64(time.Second))
+}
+
+// Middleware answers 429 Too Many Requests with Retry-After once the bucket of
+// the request is empty
+func (l *RateLimiter) Middleware(next HandlerFunc) HandlerFunc {
+	key := l.Key
+	if key == nil {
+		key = KeyByIP
+	}
+	return func(ctx *Context) {
+		ok, wait := l.Allow(key(ctx))
+		if ok {
+			next(ctx)
+			return
+		}
+		rejectWithRetryAfter(ctx, StatusTooManyRequests, wait)
+	}
+}
+
+func (sh *rateShard) lookup(h uint64, key []byte) *rateBucket {
+	for b := sh.buckets[h]; b != nil; b = b.hnext {
+		if bytes.Equal(b.key, key) {
+			return b
+		}
+	}
+	return nil
+}
+
+// insert adds a bucket for key, reusing the least recently used one when the shard is full
+func (sh *rateShard) insert(h uint64, key []byte) *rateBucket {
+	var b *rateBucket
+	if sh.n >= sh.max && sh.tail != nil {
+		b = sh.tail
+		sh.unlink(b)
+		sh.remove(b)
+	} else {
+		b = &rateBucket{}
+		sh.n++
+	}
+	b.key = append(b.key[:0], key...)
+	b.hash = h
+	b.hnext = sh.buckets[h]
+	sh.buckets[h] = b
+	sh.pushFront(b)
+	return b
+}
+
+// remove takes b out of the hash chain of its key
+func (sh *rateShard) remove(b *rateBucket) {
+	p := sh.buckets[b.hash]
+	if p == b {
+		if b.hnext == nil {
+			delete(sh.buckets, b.hash)
+		} else {
+			sh.buckets[b.hash] = b.hnext
+		}
+		b.hnext = nil
+		return
+	}
+	for ; p != nil; p = p.hnext {
+		if p.hnext == b {
+			p.hnext = b.hnext
+			break
+		}
+	}
+	b.hnext = nil
+}
+
+func (sh *rateShard) moveToFront(b *rateBucket) {
+	if sh.head == b {
+		return
+	}
+	sh.unlink(b)
+	sh.pushFront(b)
+}
+
+func (sh *rateShard) pushFront(b *rateBucket) {
+	b.prev, b.next = nil, sh.head
+	if sh.head != nil {
+		sh.head.prev = b
+	}
+	sh.head = b
+	if sh.tail == nil {
+		sh.tail = b
+	}
+}
+
+func (sh *rateShard) unlink(b *rateBucket) {
+	if b.prev != nil {
+		b.prev.next = b.next
+	} else {
+		sh.head = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	} else {
+		sh.tail = b.prev
+	}
+	b.prev, b.next = nil, nil
+}
+
+func fnv64a(b []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// ConcurrencyLimiter sheds requests once Max handlers are running
+type ConcurrencyLimiter struct {
+	//Max <= 0 runs any number of handlers
+	Max int64
+	//Status answers shed requests, 503 by default
+	Status int
+	//RetryAfter is sent with shed requests, one second by default
+	RetryAfter time.Duration
+
+	active int64
+}
+
+// NewConcurrencyLimiter lets max requests run the handler at the same time
+func NewConcurrencyLimiter(max int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		Max:        int64(max),
+		Status:     StatusServiceUnavailable,
+		RetryAfter: defaultRetryWait,
+	}
+}
+
+// Active returns the number of requests running the handler
+func (l *ConcurrencyLimiter) Active() int {
+	return int(atomic.LoadInt64(&l.active))
+}
+
+// Middleware answers Status with Retry-After instead of calling next when
+// Max requests are already running
+func (l *ConcurrencyLimiter) Middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		if atomic.AddInt64(&l.active, 1) > l.Max && l.Max > 0 {
+			atomic.AddInt64(&l.active, -1)
+			status := l.Status
+			if status == 0 {
+				status = StatusServiceUnavailable
+			}
+			rejectWithRetryAfter(ctx, status, l.RetryAfter)
+			return
+		}
+		defer atomic.AddInt64(&l.active, -1)
+		next(ctx)
+	}
+}
+
+// rejectWithRetryAfter answers status with Retry-After in whole seconds, rounded up
+func rejectWithRetryAfter(ctx *Context, status int, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	var b [20]byte
+	ctx.resp.SetStatusCode(status)
+	ctx.resp.header.Set(HeaderRetryAfter, strconv.AppendInt(b[:0], secs, 10))
+	ctx.resp.SetBody(s2b(reason(status)))
+}
@@ -0,0 +1,235 @@
+package http1
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	type step struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{"burst then wait", 2, 2, []step{{0, true, 0}, {0, true, 0}, {0, false, 500 * time.Millisecond}, {250 * time.Millisecond, false, 250 * time.Millisecond}, {250 * time.Millisecond, true, 0}}},
+		{"refill capped at burst", 10, 1, []step{{0, true, 0}, {time.Hour, true, 0}, {0, false, 100 * time.Millisecond}}},
+		{"burst below one", 1, 0, []step{{0, true, 0}, {0, false, time.Second}}},
+		{"no refill", 0, 1, []step{{0, true, 0}, {time.Hour, false, defaultRetryWait}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(tt.rate, tt.burst, KeyByIP, 0)
+			now := int64(1e9)
+			for i, s := range tt.steps {
+				now += int64(s.after)
+				if ok, wait := l.allow([]byte("k"), now); ok != s.ok || wait != s.wait {
+					t.Errorf("step %d: %v %v, want %v %v", i, ok, wait, s.ok, s.wait)
+				}
+			}
+			if ok, _ := l.allow([]byte("other"), now); !ok {
+				t.Error("other key shares the bucket")
+			}
+		})
+	}
+}
+
+func TestRateLimiterLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		l       *RateLimiter
+		allowed int
+		max     int
+	}{
+		{"zero value", &RateLimiter{}, 1, defaultRateKeys / rateLimitShards},
+		{"rate and burst", &RateLimiter{Rate: 10, Burst: 5}, 5, defaultRateKeys / rateLimitShards},
+		{"zero burst", &RateLimiter{Rate: 10, MaxKeys: 64}, 1, 2},
+		{"negative max keys", &RateLimiter{Rate: 10, Burst: 2, MaxKeys: -1}, 2, defaultRateKeys / rateLimitShards},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := int64(1e9)
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if ok, _ := tt.l.allow([]byte("k"), now); ok {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("%d requests allowed, want %d", allowed, tt.allowed)
+			}
+			for i := 0; i < 1000; i++ {
+				tt.l.allow([]byte(strconv.Itoa(i)), now)
+			}
+			for i := range tt.l.shards {
+				if sh := &tt.l.shards[i]; sh.max != tt.max || sh.n < 1 || sh.n > sh.max {
+					t.Fatalf("shard %d: %d buckets, max %d", i, sh.n, sh.max)
+				}
+			}
+		})
+	}
+
+	//a literal without Key counts per client address
+	l := &RateLimiter{Burst: 1}
+	s := NewServer(Chain(func(ctx *Context) {}, l.Middleware), 0)
+	for i, status := range []int{StatusOK, StatusTooManyRequests} {
+		out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+		if resp := readResponses(t, out, "GET")[0]; resp.StatusCode != status {
+			t.Errorf("request %d: status %d, want %d", i, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := NewRateLimiter(1, 1, KeyByIP, rateLimitShards)
+	for i := 0; i < 1000; i++ {
+		l.Allow([]byte(strconv.Itoa(i)))
+	}
+	for i := range l.shards {
+		sh := &l.shards[i]
+		chained := 0
+		for _, b := range sh.buckets {
+			for ; b != nil; b = b.hnext {
+				chained++
+			}
+		}
+		if sh.n > sh.max || chained != sh.n {
+			t.Errorf("shard %d: %d buckets, %d chained, max %d", i, sh.n, chained, sh.max)
+		}
+	}
+
+	//buckets sharing a hash are told apart by key and evicted least recently used first
+	sh := &rateShard{buckets: make(map[uint64]*rateBucket), max: 2}
+	a, b := sh.insert(7, []byte("a")), sh.insert(7, []byte("b"))
+	if sh.lookup(7, []byte("a")) != a || sh.lookup(7, []byte("b")) != b || sh.lookup(7, []byte("c")) != nil {
+		t.Fatal("lookup in a hash chain")
+	}
+	sh.moveToFront(a)
+	c := sh.insert(7, []byte("c"))
+	if c != b || sh.lookup(7, []byte("b")) != nil || sh.lookup(7, []byte("a")) != a || sh.lookup(7, []byte("c")) != c {
+		t.Error("least recently used bucket not evicted")
+	}
+	sh.insert(8, []byte("d"))
+	if sh.lookup(7, []byte("a")) != nil || sh.lookup(7, []byte("c")) != c || sh.n != 2 {
+		t.Error("head of a hash chain not evicted")
+	}
+}
+
+func TestRateLimiterAllocs(t *testing.T) {
+	l := NewRateLimiter(1, 1, KeyByIP, rateLimitShards)
+	key := []byte("k")
+	l.Allow(key)
+	if n := testing.AllocsPerRun(100, func() { l.Allow(key) }); n > 0 {
+		t.Errorf("Allow of a known key allocates %v times", n)
+	}
+	keys := make([][]byte, 256)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+		l.Allow(keys[i])
+	}
+	i := 0
+	if n := testing.AllocsPerRun(1000, func() {
+		l.Allow(keys[i%len(keys)])
+		i++
+	}); n > 0 {
+		t.Errorf("Allow evicting buckets allocates %v times", n)
+	}
+}
+
+func TestKeyByIP(t *testing.T) {
+	tests := []struct {
+		peer net.IP
+		key  net.IP
+	}{
+		{net.IPv4(10, 0, 0, 1), net.ParseIP("10.0.0.1")},
+		{net.IP{10, 0, 0, 1}, net.ParseIP("10.0.0.1")},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1")},
+	}
+	for _, tt := range tests {
+		var key []byte
+		var allocs float64
+		s := NewServer(func(ctx *Context) {
+			key = append(key, KeyByIP(ctx)...)
+			allocs = testing.AllocsPerRun(100, func() {
+				ctx.client.reset()
+				KeyByIP(ctx)
+			})
+		}, 0)
+		c := newTestConn("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+		c.addr = &net.TCPAddr{IP: tt.peer, Port: 1}
+		ctx := AcquireContext(s, c)
+		serveConn(ctx, c)
+		ReleaseContext(ctx)
+		if string(key) != string(tt.key) {
+			t.Errorf("peer %v: key %v, want %v", tt.peer, net.IP(key), tt.key)
+		}
+		if allocs > 0 {
+			t.Errorf("peer %v: KeyByIP allocates %v times", tt.peer, allocs)
+		}
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	l := NewRateLimiter(0.5, 2, KeyByHeader("X-Key"), 0)
+	s := NewServer(Chain(func(ctx *Context) {}, l.Middleware), 0)
+	tests := []struct {
+		key        string
+		status     int
+		retryAfter string
+	}{
+		{"a", StatusOK, ""},
+		{"a", StatusOK, ""},
+		{"a", StatusTooManyRequests, "2"},
+		{"b", StatusOK, ""},
+	}
+	for i, tt := range tests {
+		out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\nX-Key: "+tt.key+"\r\n\r\n")
+		resp := readResponses(t, out, "GET")[0]
+		if resp.StatusCode != tt.status || resp.Header.Get(HeaderRetryAfter) != tt.retryAfter {
+			t.Errorf("request %d: %d Retry-After %q", i, resp.StatusCode, resp.Header.Get(HeaderRetryAfter))
+		}
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		l       *ConcurrencyLimiter
+		running int64
+		status  int
+	}{
+		{"zero value", &ConcurrencyLimiter{}, 100, StatusOK},
+		{"negative max", &ConcurrencyLimiter{Max: -1}, 100, StatusOK},
+		{"below max", NewConcurrencyLimiter(2), 1, StatusOK},
+		{"at max", NewConcurrencyLimiter(2), 2, StatusServiceUnavailable},
+		{"custom status", &ConcurrencyLimiter{Max: 1, Status: StatusTooManyRequests, RetryAfter: 3 * time.Second}, 1, StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active := -1
+			s := NewServer(Chain(func(ctx *Context) { active = tt.l.Active() }, tt.l.Middleware), 0)
+			tt.l.active = tt.running
+			out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == StatusOK && active != int(tt.running)+1 {
+				t.Errorf("Active() = %d in the handler", active)
+			}
+			if tt.status != StatusOK && resp.Header.Get(HeaderRetryAfter) == "" {
+				t.Error("no Retry-After")
+			}
+			if n := tt.l.Active(); n != int(tt.running) {
+				t.Errorf("Active() = %d after the request", n)
+			}
+		})
+	}
+}
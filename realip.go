@@ -0,0 +1,239 @@
+package http1
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	byteForwardedFor   = []byte("for")
+	byteForwardedProto = []byte("proto")
+	byteForwardedHost  = []byte("host")
+)
+
+// TrustedProxies is the set of peers whose Forwarded and X-Forwarded-* headers are believed
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies parses CIDRs such as "10.0.0.0/8", a plain IP is a single address
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t, nil
+}
+
+// Contains reports whether ip belongs to a trusted proxy
+func (t *TrustedProxies) Contains(ip net.IP) bool {
+	if t == nil || ip == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfo is the client as reported by the trusted proxies in front of the server
+type clientInfo struct {
+	resolved bool
+	ip       net.IP
+	proto    []byte
+	host     []byte
+	//peer is the address of the connection, kept across its requests
+	peer    net.IP
+	peerBuf [net.IPv6len]byte
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+func (c *clientInfo) reset() {
+	c.resolved = false
+	c.ip = nil
+	c.proto = nil
+	c.host = nil
+}
+
+// RealIP returns the client address. When the peer is one of Server.TrustedProxies the
+// Forwarded header, or X-Forwarded-For without it, is walked from right to left and
+// the first address that is not a trusted proxy is returned. Entries left of it were
+// written by the client and are ignored. Repeated field lines are read as one list in
+// the order received, so a proxy appending its own line can't be bypassed. It is nil
+// when a trusted proxy hid the client with an obfuscated or unknown identifier.
+// The returned IP may be reused once the context is released.
+func (ctx *Context) RealIP() net.IP {
+	ctx.resolveClient()
+	return ctx.client.ip
+}
+
+// RealProto returns the scheme the client used, as reported by the trusted proxy it connected to
+func (ctx *Context) RealProto() []byte {
+	ctx.resolveClient()
+	return ctx.client.proto
+}
+
+// RealHost returns the host the client asked for, as reported by the trusted proxy it connected to
+func (ctx *Context) RealHost() []byte {
+	ctx.resolveClient()
+	return ctx.client.host
+}
+
+func (ctx *Context) resolveClient() {
+	c := &ctx.client
+	if c.resolved {
+		return
+	}
+	c.resolved = true
+	c.ip = ctx.peerIP()
+	c.proto = ctx.req.uri.Scheme()
+	c.host = ctx.req.uri.Host()
+	trusted := ctx.s.TrustedProxies
+	if !trusted.Contains(c.ip) {
+		return
+	}
+	if len(ctx.req.header.GetHeader(HeaderForwarded)) > 0 {
+		ctx.walkForwarded(trusted)
+		return
+	}
+	ctx.walkXForwarded(trusted)
+}
+
+// peerIP returns the address of the connection, it is parsed once per connection
+// into the context so that requests don't allocate
+func (ctx *Context) peerIP() net.IP {
+	c := &ctx.client
+	if c.peer != nil {
+		return c.peer
+	}
+	if tcp, ok := ctx.RemoteAddr().(*net.TCPAddr); ok && len(tcp.IP) > 0 {
+		//the 16 byte form, as net.ParseIP returns for forwarded addresses
+		if ip4 := tcp.IP.To4(); ip4 != nil {
+			c.peer = append(append(c.peerBuf[:0], v4InV6Prefix...), ip4...)
+		} else {
+			c.peer = append(c.peerBuf[:0], tcp.IP...)
+		}
+		return c.peer
+	}
+	c.peer = net.ParseIP(remoteIP(ctx.RemoteAddr()))
+	return c.peer
+}
+
+// walkForwarded walks the RFC 7239 elements, the proto and host of the element naming
+// the client were set by the trusted proxy it connected to
+func (ctx *Context) walkForwarded(trusted *TrustedProxies) {
+	c := &ctx.client
+	elements := listItems(&ctx.req.header, HeaderForwarded)
+	for i := len(elements) - 1; i >= 0; i-- {
+		var forIP net.IP
+		var hasFor bool
+		var proto, host []byte
+		for _, pair := range bytes.Split(elements[i], []byte(";")) {
+			n := bytes.IndexByte(pair, '=')
+			if n < 0 {
+				continue
+			}
+			key, value := bytes.TrimSpace(pair[:n]), trimQuotes(bytes.TrimSpace(pair[n+1:]))
+			switch {
+			case bytes.EqualFold(key, byteForwardedFor):
+				hasFor = true
+				forIP = parseNodeIP(value)
+			case bytes.EqualFold(key, byteForwardedProto):
+				proto = value
+			case bytes.EqualFold(key, byteForwardedHost):
+				host = value
+			}
+		}
+		if !hasFor {
+			continue
+		}
+		if len(proto) > 0 {
+			c.proto = proto
+		}
+		if len(host) > 0 {
+			c.host = host
+		}
+		c.ip = forIP
+		if !trusted.Contains(forIP) {
+			return
+		}
+	}
+}
+
+// walkXForwarded walks X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host are read
+// at the same position from the right, the hop of the chosen address. A hop without
+// a value keeps the one of the trusted hop after it
+func (ctx *Context) walkXForwarded(trusted *TrustedProxies) {
+	c := &ctx.client
+	addrs := listItems(&ctx.req.header, HeaderXForwardedFor)
+	if len(addrs) == 0 {
+		return
+	}
+	protos := listItems(&ctx.req.header, HeaderXForwardedProto)
+	hosts := listItems(&ctx.req.header, HeaderXForwardedHost)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		fromRight := len(addrs) - 1 - i
+		c.ip = parseNodeIP(addrs[i])
+		if v := listItemFromRight(protos, fromRight); len(v) > 0 {
+			c.proto = v
+		}
+		if v := listItemFromRight(hosts, fromRight); len(v) > 0 {
+			c.host = v
+		}
+		if !trusted.Contains(c.ip) {
+			return
+		}
+	}
+}
+
+// listItemFromRight returns the n-th item from the right, nil for shorter lists
+func listItemFromRight(list [][]byte, n int) []byte {
+	if n >= len(list) {
+		return nil
+	}
+	return list[len(list)-1-n]
+}
+
+// listItems returns the comma separated items of every key field line, in order
+func listItems(h *RequestHeader, key string) [][]byte {
+	var items [][]byte
+	h.VisitValues(key, func(v []byte) {
+		for _, item := range bytes.Split(v, []byte(",")) {
+			items = append(items, bytes.TrimSpace(item))
+		}
+	})
+	return items
+}
+
+// parseNodeIP parses an address with an optional port, "[v6]:port" included.
+// Obfuscated identifiers and "unknown" give nil
+func parseNodeIP(node []byte) net.IP {
+	node = trimQuotes(bytes.TrimSpace(node))
+	if len(node) > 0 && node[0] == '[' {
+		n := bytes.IndexByte(node, ']')
+		if n < 0 {
+			return nil
+		}
+		node = node[1:n]
+	} else if bytes.Count(node, byteColon) == 1 {
+		node = node[:bytes.IndexByte(node, ':')]
+	}
+	return net.ParseIP(string(node))
+}
@@ -0,0 +1,88 @@
+package http1
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := NewTrustedProxies("10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		peer   string
+		header string
+		ip     string
+		proto  string
+		host   string
+	}{
+		{"no headers", "10.0.0.1", "", "10.0.0.1", "http", "inner"},
+		{"untrusted peer", "8.8.8.8", "X-Forwarded-For: 1.2.3.4\r\nX-Forwarded-Proto: https\r\n", "8.8.8.8", "http", "inner"},
+		{"x-forwarded chain", "10.0.0.1",
+			"X-Forwarded-For: 6.6.6.6, 1.2.3.4, 192.168.1.1\r\nX-Forwarded-Proto: https\r\nX-Forwarded-Host: pub.com\r\n",
+			"1.2.3.4", "https", "pub.com"},
+		{"x-forwarded repeated lines", "10.0.0.1",
+			"X-Forwarded-For: 6.6.6.6\r\nX-Forwarded-For: 1.2.3.4\r\n", "1.2.3.4", "http", "inner"},
+		{"x-forwarded same hop", "10.0.0.1",
+			"X-Forwarded-For: 1.2.3.4, 10.1.1.1\r\nX-Forwarded-Host: pub.com, mid\r\nX-Forwarded-Proto: https, http\r\n",
+			"1.2.3.4", "https", "pub.com"},
+		{"x-forwarded hop without values", "10.0.0.1",
+			"X-Forwarded-For: 1.2.3.4, 10.1.1.1\r\nX-Forwarded-Host: mid\r\n", "1.2.3.4", "http", "mid"},
+		{"all trusted", "10.0.0.1", "X-Forwarded-For: 10.2.2.2, 10.1.1.1\r\n", "10.2.2.2", "http", "inner"},
+		{"forwarded", "10.0.0.1",
+			"Forwarded: for=6.6.6.6;proto=http, for=\"[2001:db8::1]:4711\";proto=https;host=pub.com, for=10.1.1.1:80;proto=http;host=mid\r\n",
+			"2001:db8::1", "https", "pub.com"},
+		{"forwarded repeated lines", "10.0.0.1",
+			"Forwarded: for=6.6.6.6;host=evil\r\nForwarded: for=1.2.3.4\r\n", "1.2.3.4", "http", "inner"},
+		{"forwarded wins", "10.0.0.1",
+			"X-Forwarded-For: 5.5.5.5\r\nForwarded: for=1.2.3.4\r\n", "1.2.3.4", "http", "inner"},
+		{"obfuscated", "10.0.0.1", "Forwarded: for=_hidden;proto=https\r\n", "<nil>", "https", "inner"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ip, proto, host string
+			s := NewServer(func(ctx *Context) {
+				ip, proto, host = ctx.RealIP().String(), string(ctx.RealProto()), string(ctx.RealHost())
+			}, 0)
+			s.TrustedProxies = trusted
+			c := newTestConn("GET / HTTP/1.1\r\nHost: inner\r\n" + tt.header + "\r\n")
+			c.addr = &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 1234}
+			ctx := AcquireContext(s, c)
+			serveConn(ctx, c)
+			ReleaseContext(ctx)
+			if ip != tt.ip || proto != tt.proto || host != tt.host {
+				t.Errorf("got %s %s %s, want %s %s %s", ip, proto, host, tt.ip, tt.proto, tt.host)
+			}
+		})
+	}
+}
+
+func TestNewTrustedProxies(t *testing.T) {
+	if _, err := NewTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	tp, err := NewTrustedProxies("::1", "192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{"::1": true, "::2": false, "192.168.3.4": true, "192.169.0.1": false} {
+		if got := tp.Contains(net.ParseIP(ip)); got != want {
+			t.Errorf("Contains(%s) = %v", ip, got)
+		}
+	}
+	var none *TrustedProxies
+	if none.Contains(net.ParseIP("10.0.0.1")) {
+		t.Error("nil TrustedProxies contains an address")
+	}
+}
+
+func TestRequestHeaderVisitValues(t *testing.T) {
+	r := parseRequest(t, "GET / HTTP/1.1\r\nX-A: 1\r\nx-a:2 \r\nB: 3\r\nX-A: \r\n\r\n")
+	var got []string
+	r.Header().VisitValues("X-A", func(v []byte) { got = append(got, string(v)) })
+	if len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "" {
+		t.Errorf("values %q", got)
+	}
+}
@@ -0,0 +1,178 @@
+package http1
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/bytebufferpool"
+)
+
+var ErrInvalidRedirectCode = errors.New("invalid redirect status code")
+
+var byteTextHTML = []byte("text/html; charset=utf-8")
+
+var redirectBufPool bytebufferpool.Pool
+
+// Redirect answers with code and a Location resolved against the request URI,
+// code must be 300, 301, 302, 303, 307 or 308. Non-HEAD requests get a short HTML body
+func (ctx *Context) Redirect(target string, code int) error {
+	switch code {
+	case StatusMultipleChoices, StatusMovedPermanently, StatusFound, StatusSeeOther,
+		StatusTemporaryRedirect, StatusPermanentRedirect:
+	default:
+		return errors.Wrapf(ErrInvalidRedirectCode, "%d", code)
+	}
+	buf := redirectBufPool.Get()
+	buf.B = ctx.appendResolved(buf.B[:0], s2b(target))
+	ctx.resp.SetStatusCode(code)
+	ctx.resp.header.Set(HeaderLocation, buf.B)
+	if !ctx.head {
+		ctx.resp.SetContentType(byteTextHTML)
+		body := ctx.resp.bodyBuffer()
+		body.Reset()
+		body.WriteString(`<a href="`)
+		body.WriteString(html.EscapeString(b2s(buf.B)))
+		body.WriteString(`">`)
+		body.WriteString(reason(code))
+		body.WriteString("</a>.\n")
+	}
+	redirectBufPool.Put(buf)
+	return nil
+}
+
+// appendResolved appends target resolved against the request URI as an absolute URL,
+// RFC 3986 section 5.2
+func (ctx *Context) appendResolved(dst, target []byte) []byte {
+	if hasScheme(target) {
+		return append(dst, target...)
+	}
+	dst = append(dst, ctx.RealProto()...)
+	dst = append(dst, byteColonSlashSlash...)
+	if bytes.HasPrefix(target, byteSlashSlash) {
+		return append(dst, target[len(byteSlashSlash):]...)
+	}
+	dst = append(dst, ctx.RealHost()...)
+
+	uri := &ctx.req.uri
+	basePath := uri.PathOriginal()
+	if len(basePath) == 0 || uri.IsAsterisk() {
+		basePath = byteSlash
+	}
+	switch {
+	case len(target) == 0:
+		dst = append(dst, basePath...)
+		return appendQuery(dst, uri.QueryString())
+	case target[0] == '?':
+		dst = append(dst, basePath...)
+		return append(dst, target...)
+	case target[0] == '#':
+		dst = append(dst, basePath...)
+		dst = appendQuery(dst, uri.QueryString())
+		return append(dst, target...)
+	}
+
+	path, rest := target, []byte(nil)
+	if n := bytes.IndexAny(target, "?#"); n >= 0 {
+		path, rest = target[:n], target[n:]
+	}
+	start := len(dst)
+	if path[0] != '/' {
+		//merge with the directory of the base path
+		dst = append(dst, basePath[:bytes.LastIndexByte(basePath, '/')+1]...)
+	}
+	dst = append(dst, path...)
+	dst = append(dst[:start], removeDotSegments(dst[start:])...)
+	return append(dst, rest...)
+}
+
+func appendQuery(dst, query []byte) []byte {
+	if len(query) == 0 {
+		return dst
+	}
+	dst = append(dst, '?')
+	return append(dst, query...)
+}
+
+// hasScheme reports whether target starts with a URI scheme such as "https:"
+func hasScheme(target []byte) bool {
+	for i, c := range target {
+		switch {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		case i > 0 && c == ':':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// redirectCode keeps the method for requests other than GET and HEAD
+func (ctx *Context) redirectCode() int {
+	if ctx.head || ctx.req.IsGet() {
+		return StatusMovedPermanently
+	}
+	return StatusPermanentRedirect
+}
+
+// TrailingSlashRedirect redirects paths without a trailing slash to the path with one,
+// or the reverse when add is false. The query is kept and "/" is left alone
+func TrailingSlashRedirect(add bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) {
+			//a target starting with '//' would be resolved as a reference to another host
+			path := collapseLeadingSlashes(ctx.req.uri.PathOriginal())
+			if len(path) <= 1 || ctx.req.uri.IsAsterisk() || (path[len(path)-1] == '/') == add {
+				next(ctx)
+				return
+			}
+			buf := redirectBufPool.Get()
+			if add {
+				buf.B = append(append(buf.B[:0], path...), '/')
+			} else {
+				buf.B = append(buf.B[:0], bytes.TrimRight(path, "/")...)
+				if len(buf.B) == 0 {
+					buf.B = append(buf.B, '/')
+				}
+			}
+			buf.B = appendQuery(buf.B, ctx.req.uri.QueryString())
+			ctx.Redirect(b2s(buf.B), ctx.redirectCode())
+			redirectBufPool.Put(buf)
+		}
+	}
+}
+
+// collapseLeadingSlashes returns path starting with a single '/'
+func collapseLeadingSlashes(path []byte) []byte {
+	for len(path) > 1 && path[0] == '/' && path[1] == '/' {
+		path = path[1:]
+	}
+	return path
+}
+
+// CanonicalHostRedirect redirects requests for any other host to host,
+// keeping the scheme, path and query
+func CanonicalHostRedirect(host string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) {
+			if equalFoldString(b2s(ctx.RealHost()), host) {
+				next(ctx)
+				return
+			}
+			buf := redirectBufPool.Get()
+			buf.B = append(buf.B[:0], ctx.RealProto()...)
+			buf.B = append(buf.B, byteColonSlashSlash...)
+			buf.B = append(buf.B, host...)
+			path := ctx.req.uri.PathOriginal()
+			if len(path) == 0 {
+				path = byteSlash
+			}
+			buf.B = append(buf.B, path...)
+			buf.B = appendQuery(buf.B, ctx.req.uri.QueryString())
+			ctx.Redirect(b2s(buf.B), ctx.redirectCode())
+			redirectBufPool.Put(buf)
+		}
+	}
+}
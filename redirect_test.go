@@ -0,0 +1,85 @@
+package http1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		code     int
+		raw      string
+		status   int
+		location string
+	}{
+		{"relative", "../x/./y?z=1", StatusFound, "GET /a/b/c?q=1 HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusFound, "http://ex.com/a/x/y?z=1"},
+		{"query only", "?z", StatusMovedPermanently, "GET /a/b?q HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusMovedPermanently, "http://ex.com/a/b?z"},
+		{"empty", "", StatusSeeOther, "GET /a/b?q HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusSeeOther, "http://ex.com/a/b?q"},
+		{"fragment", "#f", StatusFound, "GET /a?q HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusFound, "http://ex.com/a?q#f"},
+		{"absolute path", "/p/../q", StatusFound, "GET /a/b HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusFound, "http://ex.com/q"},
+		{"network path", "//other.com/p", StatusTemporaryRedirect, "GET /a HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusTemporaryRedirect, "http://other.com/p"},
+		{"absolute", "https://x.com/<>", StatusPermanentRedirect, "GET /a HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusPermanentRedirect, "https://x.com/<>"},
+		{"asterisk base", "x", StatusFound, "OPTIONS * HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusFound, "http://ex.com/x"},
+		{"invalid code", "/x", StatusNotModified, "GET /a HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			s := NewServer(func(ctx *Context) { err = ctx.Redirect(tt.target, tt.code) }, 0)
+			out, _ := serveString(s, tt.raw)
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status || resp.Header.Get(HeaderLocation) != tt.location {
+				t.Fatalf("got %d %q, want %d %q", resp.StatusCode, resp.Header.Get(HeaderLocation), tt.status, tt.location)
+			}
+			if (err != nil) != (tt.location == "") {
+				t.Errorf("error %v", err)
+			}
+			if body := readBody(resp); strings.Contains(body, "<>") {
+				t.Errorf("location not escaped in body %q", body)
+			}
+		})
+	}
+
+	s := NewServer(func(ctx *Context) { ctx.Redirect("/x", StatusFound) }, 0)
+	out, _ := serveString(s, "HEAD /a HTTP/1.1\r\nHost: ex.com\r\n\r\n")
+	if resp := readResponses(t, out, "HEAD")[0]; resp.Header.Get(HeaderLocation) != "http://ex.com/x" || resp.ContentLength != 0 {
+		t.Errorf("HEAD response %q", out)
+	}
+}
+
+func TestRedirectMiddleware(t *testing.T) {
+	ok := func(ctx *Context) { ctx.Response().SetBody([]byte("ok")) }
+	add := NewServer(Chain(ok, CanonicalHostRedirect("www.ex.com"), TrailingSlashRedirect(true)), 0)
+	remove := NewServer(Chain(ok, TrailingSlashRedirect(false)), 0)
+	tests := []struct {
+		name     string
+		s        *Server
+		raw      string
+		status   int
+		location string
+	}{
+		{"other host", add, "GET /a?x=1 HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusMovedPermanently, "http://www.ex.com/a?x=1"},
+		{"other host double slash", add, "GET //evil.com HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusMovedPermanently, "http://www.ex.com//evil.com"},
+		{"add slash", add, "GET /a?x=1 HTTP/1.1\r\nHost: www.ex.com\r\n\r\n", StatusMovedPermanently, "http://www.ex.com/a/?x=1"},
+		{"add slash post", add, "POST /a HTTP/1.1\r\nHost: www.ex.com\r\nContent-Length: 0\r\n\r\n", StatusPermanentRedirect, "http://www.ex.com/a/"},
+		{"has slash", add, "GET /a/ HTTP/1.1\r\nHost: www.ex.com\r\n\r\n", StatusOK, ""},
+		{"root", add, "GET / HTTP/1.1\r\nHost: www.ex.com\r\n\r\n", StatusOK, ""},
+		{"add slash double slash", add, "GET //evil.com HTTP/1.1\r\nHost: www.ex.com\r\n\r\n", StatusMovedPermanently, "http://www.ex.com/evil.com/"},
+		{"add slash many slashes", add, "GET ///evil.com/x HTTP/1.1\r\nHost: www.ex.com\r\n\r\n", StatusMovedPermanently, "http://www.ex.com/evil.com/x/"},
+		{"remove slash", remove, "GET /a//?x HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusMovedPermanently, "http://ex.com/a?x"},
+		{"no slash", remove, "GET /a HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusOK, ""},
+		{"remove slash double slash", remove, "GET //evil.com/ HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusMovedPermanently, "http://ex.com/evil.com"},
+		{"only slashes", remove, "GET /// HTTP/1.1\r\nHost: ex.com\r\n\r\n", StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := serveString(tt.s, tt.raw)
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status || resp.Header.Get(HeaderLocation) != tt.location {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, resp.Header.Get(HeaderLocation), tt.status, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package http1
+
+import (
+	"context"
+	"io"
+)
+
+type userValue struct {
+	key   interface{}
+	value interface{}
+}
+
+// Context returns the context.Context of the current request. It is cancelled once the
+// response is written, when ServeHttp fails or the Context is released, and when
+// Server.BaseContext is cancelled. Server.RequestTimeout sets its deadline, counted from
+// the first byte of the request.
+// The handler runs on the goroutine serving the connection, so a client that goes away
+// meanwhile is only noticed after it returns and doesn't cancel the context. Bound slow
+// handlers with RequestTimeout or HandlerTimeout instead
+func (ctx *Context) Context() context.Context {
+	if ctx.reqCtx == nil {
+		base := ctx.s.BaseContext
+		if base == nil {
+			base = context.Background()
+		}
+		if ctx.s.RequestTimeout > 0 {
+			ctx.reqCtx, ctx.cancel = context.WithDeadline(base, ctx.start.Add(ctx.s.RequestTimeout))
+		} else {
+			ctx.reqCtx, ctx.cancel = context.WithCancel(base)
+		}
+	}
+	return ctx.reqCtx
+}
+
+func (ctx *Context) cancelRequest() {
+	if ctx.cancel != nil {
+		ctx.cancel()
+		ctx.cancel = nil
+	}
+	ctx.reqCtx = nil
+}
+
+// SetUserValue stores value under key until the request is done. Keys are compared
+// with == like context.Context keys, an unexported key type avoids collisions.
+// A value that is an io.Closer is closed when the request is done, it must not be
+// used after that. A value replaced by another one is not closed
+func (ctx *Context) SetUserValue(key, value interface{}) {
+	for i := range ctx.userValues {
+		if ctx.userValues[i].key == key {
+			ctx.userValues[i].value = value
+			return
+		}
+	}
+	ctx.userValues = append(ctx.userValues, userValue{key: key, value: value})
+}
+
+// UserValue returns the value stored under key, nil without one
+func (ctx *Context) UserValue(key interface{}) interface{} {
+	for i := range ctx.userValues {
+		if ctx.userValues[i].key == key {
+			return ctx.userValues[i].value
+		}
+	}
+	return nil
+}
+
+// VisitUserValues calls f for every stored value in the order they were first set
+func (ctx *Context) VisitUserValues(f func(key, value interface{})) {
+	for i := range ctx.userValues {
+		f(ctx.userValues[i].key, ctx.userValues[i].value)
+	}
+}
+
+// resetUserValues drops the values of the finished request, values that are
+// an io.Closer are closed
+func (ctx *Context) resetUserValues() {
+	for i := range ctx.userValues {
+		if c, ok := ctx.userValues[i].value.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	ctx.dropUserValues()
+}
+
+// dropUserValues forgets the values without closing them
+func (ctx *Context) dropUserValues() {
+	for i := range ctx.userValues {
+		ctx.userValues[i] = userValue{}
+	}
+	ctx.userValues = ctx.userValues[:0]
+}
@@ -0,0 +1,102 @@
+package http1
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name     string
+		base     context.Context
+		timeout  time.Duration
+		deadline bool
+		errIn    error
+	}{
+		{"background", nil, 0, false, nil},
+		{"request timeout", nil, time.Minute, true, nil},
+		{"cancelled base", cancelled, 0, false, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var contexts []context.Context
+			var errIn error
+			var deadline time.Time
+			var hasDeadline bool
+			s := NewServer(func(ctx *Context) {
+				c := ctx.Context()
+				if c != ctx.Context() {
+					t.Error("Context changed during the request")
+				}
+				contexts = append(contexts, c)
+				errIn = c.Err()
+				deadline, hasDeadline = c.Deadline()
+				if hasDeadline && !deadline.Equal(ctx.start.Add(tt.timeout)) {
+					t.Errorf("deadline %v, start %v", deadline, ctx.start)
+				}
+			}, 0)
+			s.BaseContext = tt.base
+			s.RequestTimeout = tt.timeout
+			serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+			if len(contexts) != 2 || contexts[0] == contexts[1] {
+				t.Fatalf("contexts %v", contexts)
+			}
+			if errIn != tt.errIn || hasDeadline != tt.deadline {
+				t.Errorf("in handler: err %v deadline %v", errIn, hasDeadline)
+			}
+			for i, c := range contexts {
+				if c.Err() != context.Canceled {
+					t.Errorf("context %d not cancelled after the response: %v", i, c.Err())
+				}
+			}
+		})
+	}
+}
+
+type testKey struct{}
+
+type testCloser struct {
+	closed int
+}
+
+func (c *testCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestUserValues(t *testing.T) {
+	replaced, kept := &testCloser{}, &testCloser{}
+	var seen []interface{}
+	var second interface{}
+	n := 0
+	s := NewServer(func(ctx *Context) {
+		n++
+		if n == 2 {
+			second = ctx.UserValue(testKey{})
+			return
+		}
+		ctx.SetUserValue(testKey{}, replaced)
+		ctx.SetUserValue("b", 2)
+		ctx.SetUserValue(testKey{}, kept)
+		ctx.VisitUserValues(func(k, v interface{}) { seen = append(seen, k, v) })
+		if ctx.UserValue("missing") != nil || ctx.UserValue("b") != 2 {
+			t.Error("UserValue lookup")
+		}
+		if kept.closed != 0 {
+			t.Error("value closed during the request")
+		}
+	}, 0)
+	serveString(s, "GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if len(seen) != 4 || seen[0] != (testKey{}) || seen[1] != kept || seen[2] != "b" || seen[3] != 2 {
+		t.Errorf("visited %v", seen)
+	}
+	if second != nil {
+		t.Errorf("value carried over to the next request: %v", second)
+	}
+	if kept.closed != 1 || replaced.closed != 0 {
+		t.Errorf("closed: kept %d, replaced %d", kept.closed, replaced.closed)
+	}
+}
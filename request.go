@@ -2,8 +2,8 @@ package http1
 
 import (
 	"bytes"
-	"io"
-	"net/url"
+	"encoding/base64"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/valyala/bytebufferpool"
@@ -11,9 +11,14 @@ import (
 )
 
 const maxLineLength = 4096
+const maxHeaderSize = 1 << 16
 
 var ErrLineTooLong = errors.New("header line too long")
 var ErrBodyTooLarge = errors.New("body size  too large")
+var ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+var ErrURITooLong = errors.New("request uri too long")
+var ErrHeaderTooLarge = errors.New("request header fields too large")
+var ErrInvalidRequestTarget = errors.New("request target form doesn't match the method")
 
 var defaultUserAgent = []byte("http1-client/1.1")
 
@@ -29,7 +34,14 @@ type RequestHeader struct {
 	ContentLength    int //-1 means chunked  -2 means identity
 	Host             []byte
 	TransferEncoding [][]byte
-	URL              *url.URL
+
+	//authBuf and proxyAuthBuf hold the decoded Basic credentials of Authorization
+	//and Proxy-Authorization, they are reused between requests
+	authBuf      []byte
+	proxyAuthBuf []byte
+	//raw is the request line and header block as received, Headers keeps only
+	//the first line of a repeated field
+	raw []byte
 }
 
 func (r *RequestHeader) Reset() {
@@ -37,7 +49,133 @@ func (r *RequestHeader) Reset() {
 	r.HTTP11 = false
 	r.Close = false
 	r.Host = nil
-	r.URL = nil
+	r.authBuf = r.authBuf[:0]
+	r.proxyAuthBuf = r.proxyAuthBuf[:0]
+	r.raw = nil
+}
+
+// VisitValues calls f with the value of every field line named key in the order
+// they were received. GetHeader only returns the first line of a repeated field
+func (r *RequestHeader) VisitValues(key string, f func(value []byte)) {
+	visitHeaderLines(r.raw, func(k, v []byte) {
+		if equalFoldString(key, b2s(k)) {
+			f(v)
+		}
+	})
+}
+
+// visitHeaderLines calls f with the name and trimmed value of every field line of
+// head in wire order, head starts with the request or status line
+func visitHeaderLines(head []byte, f func(key, value []byte)) {
+	//skip the request or status line
+	if n := bytes.IndexByte(head, '\n'); n >= 0 {
+		head = head[n+1:]
+	}
+	for len(head) > 0 {
+		line := head
+		if n := bytes.IndexByte(head, '\n'); n >= 0 {
+			line, head = head[:n], head[n+1:]
+		} else {
+			head = nil
+		}
+		n := bytes.IndexByte(line, ':')
+		if n < 0 {
+			continue
+		}
+		f(line[:n], bytes.TrimSpace(line[n+1:]))
+	}
+}
+
+// ContentType returns the media type of the Content-Type header and its parameters,
+// case is kept as sent
+func (r *RequestHeader) ContentType() (mediaType []byte, params HeaderParams) {
+	v := r.GetHeader(HeaderContentType)
+	if i := bytes.IndexByte(v, ';'); i >= 0 {
+		return bytes.TrimSpace(v[:i]), HeaderParams(v[i+1:])
+	}
+	return bytes.TrimSpace(v), nil
+}
+
+func (r *RequestHeader) UserAgent() []byte {
+	return r.GetHeader(HeaderUserAgent)
+}
+
+func (r *RequestHeader) Referer() []byte {
+	return r.GetHeader(HeaderReferer)
+}
+
+// GetContentLength returns the Content-Length value, -1 when the header is missing
+// or the body is chunked. The ContentLength field keeps the framing state
+func (r *RequestHeader) GetContentLength() int {
+	if r.ContentLength < 0 || len(r.GetHeader(HeaderContentLength)) == 0 {
+		return -1
+	}
+	return r.ContentLength
+}
+
+// Cookie returns the value of the named cookie from the Cookie header
+func (r *RequestHeader) Cookie(name string) []byte {
+	for _, v := range r.Headers.Values(HeaderCookie) {
+		for len(v) > 0 {
+			var pair []byte
+			if i := bytes.IndexByte(v, ';'); i >= 0 {
+				pair, v = v[:i], v[i+1:]
+			} else {
+				pair, v = v, nil
+			}
+			pair = bytes.TrimSpace(pair)
+			if i := bytes.IndexByte(pair, '='); i >= 0 && b2s(pair[:i]) == name {
+				return trimQuotes(pair[i+1:])
+			}
+		}
+	}
+	return nil
+}
+
+// BasicAuth returns the credentials of an 'Authorization: Basic' header,
+// the decoded bytes live in a buffer owned by the request
+func (r *RequestHeader) BasicAuth() (user, password []byte, ok bool) {
+	return basicAuth(r.GetHeader(HeaderAuthorization), &r.authBuf)
+}
+
+// ProxyBasicAuth returns the credentials of a 'Proxy-Authorization: Basic' header,
+// they are decoded into their own buffer so both stay valid together
+func (r *RequestHeader) ProxyBasicAuth() (user, password []byte, ok bool) {
+	return basicAuth(r.GetHeader(HeaderProxyAuthorization), &r.proxyAuthBuf)
+}
+
+// basicAuth decodes the Basic credentials of v into *buf
+func basicAuth(v []byte, buf *[]byte) (user, password []byte, ok bool) {
+	if len(v) < len(byteBasicSpace) || !bytes.EqualFold(v[:len(byteBasicSpace)], byteBasicSpace) {
+		return
+	}
+	v = bytes.TrimSpace(v[len(byteBasicSpace):])
+	n := base64.StdEncoding.DecodedLen(len(v))
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	n, err := base64.StdEncoding.Decode((*buf)[:n], v)
+	if err != nil {
+		return
+	}
+	b := (*buf)[:n]
+	*buf = b
+	i := bytes.IndexByte(b, ':')
+	if i < 0 {
+		return
+	}
+	return b[:i], b[i+1:], true
+}
+
+// IfModifiedSince returns the If-Modified-Since time, ok is false
+// when the header is missing or not a valid HTTP-date
+func (r *RequestHeader) IfModifiedSince() (t time.Time, ok bool) {
+	v := r.GetHeader(HeaderIfModifiedSince)
+	if len(v) == 0 {
+		return
+	}
+	t, err := ParseHTTPDate(v)
+	return t, err == nil
 }
 
 func (r *RequestHeader) Read(input []byte) (int, error) {
@@ -48,23 +186,107 @@ func (r *RequestHeader) Read(input []byte) (int, error) {
 	return n, nil
 }
 
-var requestBodyPool bytebufferpool.Pool
+var requestBodyPool bufferPool
 
 type Request struct {
 	header              RequestHeader
 	body                *bytebufferpool.ByteBuffer
 	MaxBodySize         int
 	parseHeaderComplete bool
+	limits              Limits
+	uri                 URI
+	//wireSize counts the header and body bytes consumed from the connection
+	wireSize int
+	//copyBuf backs the fields of a request filled by copyTo
+	copyBuf []byte
+
+	//sink takes the body as it arrives instead of body, see streamTo
+	sink bodySink
+	//sinkLeft is what is left of the body or of the current chunk
+	sinkLeft int
+	//sinkCRLF means the CRLF ending the current chunk is due
+	sinkCRLF bool
+	//sinkSize counts the body bytes handed to sink
+	sinkSize int
+}
+
+// bodySink takes a request body from ContinueReadBody as it arrives. It keeps its
+// write errors so the rest of the body is still read from the connection
+type bodySink interface {
+	writeBody(p []byte)
+	//endBody is called after the last byte of the body
+	endBody()
+	//Close releases what the sink holds, it is called when the request is reset
+	Close() error
 }
 
 func (r *Request) Reset() {
+	r.closeSink()
 	r.header.Reset()
-	r.MaxBodySize = 0
+	r.uri.Reset()
+	r.MaxBodySize = r.limits.MaxBodySize
 	r.parseHeaderComplete = false
+	r.wireSize = 0
 	//r.body not need to reset See `(r *Request) parse` method
 	//r.body.Reset()
 }
 
+// copyTo makes dst a copy of r that stays valid once r is reset
+// and the connection buffer it was parsed from is reused
+func (r *Request) copyTo(dst *Request) {
+	dst.Reset()
+	size := len(r.header.Method) + len(r.header.Proto) + len(r.header.URI) + len(r.header.raw)
+	for _, values := range r.header.Headers {
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	buf := dst.copyBuf[:0]
+	if cap(buf) < size {
+		buf = make([]byte, 0, size)
+	}
+	clone := func(b []byte) []byte {
+		if b == nil {
+			return nil
+		}
+		n := len(buf)
+		buf = append(buf, b...)
+		return buf[n:len(buf):len(buf)]
+	}
+	h := &dst.header
+	h.Method = clone(r.header.Method)
+	h.Proto = clone(r.header.Proto)
+	h.URI = clone(r.header.URI)
+	h.raw = clone(r.header.raw)
+	h.Headers = make(httparse.Header, len(r.header.Headers))
+	for k, values := range r.header.Headers {
+		copied := make([][]byte, len(values))
+		for i, v := range values {
+			copied[i] = clone(v)
+		}
+		h.Headers[k] = copied
+	}
+	dst.copyBuf = buf
+	h.HTTP11 = r.header.HTTP11
+	h.Close = r.header.Close
+	h.ContentLength = r.header.ContentLength
+	h.Host = h.GetHeader(HeaderHost)
+	if len(r.header.TransferEncoding) > 0 {
+		h.TransferEncoding = chunkedEncoding
+	}
+	dst.uri.Parse(h.Host, h.URI)
+
+	if dst.body == nil {
+		dst.body = requestBodyPool.Get()
+	}
+	dst.body.Reset()
+	dst.body.Write(r.Body())
+	dst.limits = r.limits
+	dst.MaxBodySize = r.MaxBodySize
+	dst.parseHeaderComplete = r.parseHeaderComplete
+	dst.wireSize = r.wireSize
+}
+
 func NewRequst(RemoteAddr string) *Request {
 	return &Request{
 		header: RequestHeader{
@@ -74,7 +296,28 @@ func NewRequst(RemoteAddr string) *Request {
 }
 
 func (r *Request) Set(maxBodySize int) {
-	r.MaxBodySize = maxLineLength
+	r.MaxBodySize = maxBodySize
+}
+
+// SetLimits applies l to this and the following requests read into r
+func (r *Request) SetLimits(l Limits) {
+	r.limits = l
+	r.MaxBodySize = l.MaxBodySize
+}
+
+// URI returns the parsed request target
+func (r *Request) URI() *URI {
+	return &r.uri
+}
+
+// Host returns the Host header of the request
+func (r *Request) Host() []byte {
+	return r.header.Host
+}
+
+// ContentLength returns the Content-Length value, -1 when the header is missing or the body is chunked
+func (r *Request) ContentLength() int {
+	return r.header.GetContentLength()
 }
 
 func (r *Request) ShouldClose() bool {
@@ -96,8 +339,20 @@ func (r *Request) Header() *RequestHeader {
 	return &r.header
 }
 
+func (r *Request) IsGet() bool {
+	return bytes.Equal(r.header.Method, byteGet)
+}
+
+func (r *Request) IsHead() bool {
+	return bytes.Equal(r.header.Method, byteHead)
+}
+
+func (r *Request) IsConnect() bool {
+	return bytes.Equal(r.header.Method, byteConnect)
+}
+
 func (r *Request) IsContinue() bool {
-	if v := r.header.GetHeader(HeaderExpect); bytes.Equal(v, byte100Continue) {
+	if v := r.header.GetHeader(HeaderExpect); bytes.EqualFold(bytes.TrimSpace(v), byte100Continue) {
 		return true
 	}
 	return false
@@ -113,7 +368,127 @@ func (r *Request) Parse(input Conn) error {
 	return err
 }
 
-func (r *Request) ContinueReadBody(input Conn) (err error) {
+func (r *Request) ContinueReadBody(input Conn) error {
+	if r.header.ContentLength == 0 || r.header.ContentLength == -2 {
+		if r.body != nil {
+			r.body.Reset()
+		}
+		return nil
+	}
+	buf, err := input.Bytes()
+	if err != nil {
+		return err
+	}
+	if r.sink != nil {
+		n, err := r.streamBody(buf)
+		input.Shift(n)
+		r.wireSize += n
+		return newParseError(err)
+	}
+	n, err := r.readBody(buf)
+	if err != nil {
+		return newParseError(err)
+	}
+	input.Shift(n)
+	r.wireSize += n
+	return nil
+}
+
+// streamTo makes ContinueReadBody hand the body to sink as it arrives instead of
+// reading it into Body, it is called once the header is parsed
+func (r *Request) streamTo(sink bodySink) {
+	if r.body != nil {
+		r.body.Reset()
+	}
+	r.sink = sink
+	r.sinkLeft = 0
+	if r.header.ContentLength > 0 {
+		r.sinkLeft = r.header.ContentLength
+	}
+	r.sinkCRLF = false
+	r.sinkSize = 0
+}
+
+func (r *Request) closeSink() {
+	if r.sink != nil {
+		r.sink.Close()
+		r.sink = nil
+	}
+	r.sinkSize = 0
+}
+
+// bodySize is the size of the body read into Body or streamed to the sink
+func (r *Request) bodySize() int {
+	return len(r.Body()) + r.sinkSize
+}
+
+// streamBody hands what input holds of the body to r.sink and returns the bytes it
+// consumed, it returns StatusPartial until the body and its trailers are complete
+func (r *Request) streamBody(input []byte) (n int, err error) {
+	if r.header.ContentLength > 0 {
+		if r.MaxBodySize > 0 && r.header.ContentLength > r.MaxBodySize {
+			return 0, ErrBodyTooLarge
+		}
+		n = r.sinkPart(input)
+		if r.sinkLeft > 0 {
+			return n, StatusPartial
+		}
+		r.sink.endBody()
+		return n, nil
+	}
+	lineLength := r.limits.chunkLineLength()
+	for {
+		n += r.sinkPart(input[n:])
+		if r.sinkLeft > 0 {
+			return n, StatusPartial
+		}
+		if r.sinkCRLF {
+			if len(input)-n < len(byteCRLF) {
+				return n, StatusPartial
+			}
+			if !bytes.Equal(input[n:n+len(byteCRLF)], byteCRLF) {
+				return n, errors.Errorf("cannot find crlf at the end of chunk")
+			}
+			n += len(byteCRLF)
+			r.sinkCRLF = false
+		}
+		size, m, err := parseChunkSize(input[n:], lineLength)
+		if err != nil {
+			return n, err
+		}
+		if size == 0 {
+			t, err := skipTrailer(input[n+m:], lineLength)
+			if err != nil {
+				return n, err
+			}
+			r.sink.endBody()
+			return n + m + t, nil
+		}
+		if r.MaxBodySize > 0 && size > r.MaxBodySize-r.sinkSize {
+			return n, ErrBodyTooLarge
+		}
+		n += m
+		r.sinkLeft = size
+		r.sinkCRLF = true
+	}
+}
+
+// sinkPart hands the part of input belonging to the current chunk or body to r.sink
+func (r *Request) sinkPart(input []byte) int {
+	n := r.sinkLeft
+	if n > len(input) {
+		n = len(input)
+	}
+	if n > 0 {
+		r.sink.writeBody(input[:n])
+		r.sinkLeft -= n
+		r.sinkSize += n
+	}
+	return n
+}
+
+// readBody copies the body from input to r.body and returns the bytes it used
+func (r *Request) readBody(input []byte) (n int, err error) {
 	if r.body == nil {
 		r.body = requestBodyPool.Get()
 	}
@@ -126,25 +501,13 @@ func (r *Request) ContinueReadBody(input Conn) (err error) {
 			err = ErrBodyTooLarge
 			return
 		}
-		if input.Buffered() < r.header.ContentLength {
-			err = StatusPartial
-			return
-		}
-
-		buf, err0 := input.Bytes()
-		if err0 != nil {
-			return err0
-		}
-
-		bodyBuf.B, err = appendBodyFixedSize(buf, bodyBuf.B, r.header.ContentLength)
+		bodyBuf.B, err = appendBodyFixedSize(input, bodyBuf.B, r.header.ContentLength)
 		if err != nil {
 			return
 		}
+		n = r.header.ContentLength
 	case r.header.ContentLength == -1:
-		bodyBuf.B, err = readChunked(input, r.MaxBodySize, bodyBuf.B)
-		if err != nil {
-			return
-		}
+		bodyBuf.B, n, err = readChunked(input, r.MaxBodySize, r.limits.chunkLineLength(), bodyBuf.B)
 	}
 	return
 }
@@ -158,75 +521,144 @@ func (r *Request) BodyRelease() {
 
 func (r *Request) parse(input Conn) (err error) {
 	if !r.parseHeaderComplete {
-
-		buf, err0 := input.Bytes()
-		if err0 != nil {
-			return err0
-		}
-		n, err := r.header.Read(buf)
-		if err != nil {
+		if err = r.parseHeader(input); err != nil {
 			return err
 		}
-		input.Shift(n)
-		r.parseHeaderComplete = true
+		//'Expect: 100-continue' header need to feedback a response to clinet ,no do it here
+		if r.IsContinue() {
+			return nil
+		}
+	}
+	return r.ContinueReadBody(input)
+}
+
+// parseHeader reads the request line and headers and works out the body framing,
+// the body itself is left in input
+func (r *Request) parseHeader(input Conn) (err error) {
+	buf, err := input.Bytes()
+	if err != nil {
+		return err
+	}
+	lineEnd := bytes.IndexByte(buf, '\n')
+	if lineEnd > r.limits.requestLineLength() ||
+		(lineEnd == -1 && len(buf) > r.limits.requestLineLength()) {
+		return newParseError(ErrURITooLong)
+	}
+	n, err := r.header.Read(buf)
+	if err != nil {
+		if errors.Cause(err) == StatusPartial {
+			if len(buf) < r.limits.headerBytes() {
+				return StatusPartial
+			}
+			return newParseError(ErrHeaderTooLarge)
+		}
+		return newParseError(err)
+	}
+	if n > r.limits.headerBytes() ||
+		(r.limits.MaxHeaderCount > 0 && headerLines(buf[:n]) > r.limits.MaxHeaderCount) {
+		return newParseError(ErrHeaderTooLarge)
+	}
+	r.header.raw = buf[:n]
+	input.Shift(n)
+	r.wireSize = n
+	r.parseHeaderComplete = true
+	r.header.Host = r.header.GetHeader(HeaderHost)
+	r.uri.Parse(r.header.Host, r.header.URI)
+	if err = r.checkTarget(); err != nil {
+		return newParseError(err)
+	}
+
+	r.header.HTTP11 = bytes.Equal(r.header.Proto, byteHTTP11)
+	if conn := r.header.GetHeader(HeaderConnection); r.header.HTTP11 {
+		r.header.Close = bytes.EqualFold(conn, byteClose)
+	} else {
+		r.header.Close = !bytes.EqualFold(conn, byteKeepAlive)
 	}
 
 	r.header.ContentLength = -2
 
 	r.header.TransferEncoding, err = fixTransferEncoding(r.header.Headers)
 	if err != nil {
-		return err
+		return newParseError(err)
 	}
 
 	realLength, err := fixLength(false, 0, r.header.Method,
 		r.header.Headers, r.header.TransferEncoding)
 	if err != nil {
-		return err
+		return newParseError(err)
 	}
 
 	r.header.ContentLength = realLength
+	return nil
+}
 
-	//'Expect: 100-continue' header need to feedback a response to clinet ,no do it here
-	if r.IsContinue() ||
-		r.header.ContentLength == 0 ||
-		r.header.ContentLength == -2 {
-		return nil
+// checkTarget rejects a request target whose form the method doesn't allow,
+// the authority form is only valid for CONNECT and the asterisk form for OPTIONS
+func (r *Request) checkTarget() error {
+	if r.uri.IsAuthority() != r.IsConnect() ||
+		(r.uri.IsAsterisk() && !bytes.Equal(r.header.Method, byteOptions)) {
+		return errors.Wrapf(ErrInvalidRequestTarget, "%s %q", r.header.Method, r.header.URI)
 	}
+	return nil
+}
 
-	err = r.ContinueReadBody(input)
-	if err != nil {
-		return err
-	}
-	return
+// headerLines counts the field lines of a request head, the request line and
+// the empty line ending it excluded. Headers keeps one entry per name, so it
+// can't bound repeated fields
+func headerLines(head []byte) int {
+	return bytes.Count(head, byteLF) - 2
 }
 
-func readChunked(input Conn, maxBodySize int, dst []byte) ([]byte, error) {
+// readChunked decodes a whole chunked body from buf,
+// it returns StatusPartial until the last chunk and the trailers are complete
+func readChunked(buf []byte, maxBodySize, maxLineLength int, dst []byte) ([]byte, int, error) {
 	crlfLen := 2
-	//read := 0
+	read := 0
 	for {
-		buf, err := input.Bytes()
+		chunkSize, n, err := parseChunkSize(buf[read:], maxLineLength)
 		if err != nil {
-			return nil, err
+			return dst, 0, err
 		}
-		chunkSize, n, err := parseChunkSize(buf)
-		if err != nil {
-			return dst, err
+		read += n
+		if chunkSize == 0 {
+			n, err = skipTrailer(buf[read:], maxLineLength)
+			if err != nil {
+				return dst, 0, err
+			}
+			return dst, read + n, nil
 		}
-		input.Shift(n)
-		if maxBodySize > 0 && len(dst)+chunkSize > maxBodySize {
-			return dst, ErrBodyTooLarge
+		if maxBodySize > 0 && chunkSize > maxBodySize-len(dst) {
+			return dst, 0, ErrBodyTooLarge
 		}
-		buf, _ = input.Bytes()
-		dst, err = appendBodyFixedSize(buf, dst, chunkSize+crlfLen)
-		if err != nil {
-			return dst, err
+		if chunkSize > len(buf)-read-crlfLen {
+			return dst, 0, StatusPartial
 		}
-		if !bytes.Equal(dst[len(dst)-crlfLen:], byteCRLF) {
-			return dst, errors.Errorf("cannot find crlf at the end of chunk")
+		if !bytes.Equal(buf[read+chunkSize:read+chunkSize+crlfLen], byteCRLF) {
+			return dst, 0, errors.Errorf("cannot find crlf at the end of chunk")
 		}
-		dst = dst[:len(dst)-crlfLen]
-		if chunkSize == 0 {
-			return dst, nil
+		dst = append(dst, buf[read:read+chunkSize]...)
+		read += chunkSize + crlfLen
+	}
+}
+
+// skipTrailer skips the trailer fields after the last chunk up to the empty line
+func skipTrailer(input []byte, maxLineLength int) (int, error) {
+	read := 0
+	for {
+		p := bytes.IndexByte(input[read:], '\n')
+		if p == -1 {
+			if len(input)-read >= maxLineLength {
+				return 0, ErrLineTooLong
+			}
+			return 0, StatusPartial
+		}
+		if p+1 >= maxLineLength {
+			return 0, ErrLineTooLong
+		}
+		line := input[read : read+p]
+		read += p + 1
+		if len(trimTrailingWhitespace(line)) == 0 {
+			return read, nil
 		}
 	}
 }
@@ -266,9 +698,9 @@ func round2(n int) int {
 	return 1 << x
 }
 
-func parseChunkSize(input []byte) (int, int, error) {
+func parseChunkSize(input []byte, maxLineLength int) (int, int, error) {
 	var line []byte
-	line, n, err := readChunkLine(input)
+	line, n, err := readChunkLine(input, maxLineLength)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -276,12 +708,12 @@ func parseChunkSize(input []byte) (int, int, error) {
 	if err != nil {
 		return 0, 0, errors.WithStack(err)
 	}
-	if len == 0 {
-		return 0, 0, errors.WithStack(io.EOF)
-	}
 	return len, n, nil
 }
 
+// maxChunkSize is the largest chunk size parseHexUint accepts
+const maxChunkSize = int(^uint(0) >> 1)
+
 func parseHexUint(v []byte) (n int, err error) {
 	for i, b := range v {
 		switch {
@@ -294,7 +726,8 @@ func parseHexUint(v []byte) (n int, err error) {
 		default:
 			return 0, errors.New("invalid byte in chunk length")
 		}
-		if i == 16 {
+		//a size that doesn't fit in an int would turn negative and pass the limits
+		if i == 16 || n > maxChunkSize>>4 {
 			return 0, errors.New("http chunk length too large")
 		}
 		n <<= 4
@@ -303,17 +736,18 @@ func parseHexUint(v []byte) (n int, err error) {
 	return
 }
 
-func readChunkLine(input []byte) ([]byte, int, error) {
+func readChunkLine(input []byte, maxLineLength int) ([]byte, int, error) {
 	p := bytes.Index(input, []byte{'\n'})
 	if p == -1 {
+		if len(input) >= maxLineLength {
+			return nil, 0, ErrLineTooLong
+		}
 		return nil, 0, StatusPartial
 	}
 	if p+1 >= maxLineLength {
 		return nil, 0, ErrLineTooLong
 	}
-	b := make([]byte, p+1)
-	copy(b, input[:p])
-	b = trimTrailingWhitespace(b)
+	b := trimTrailingWhitespace(input[:p])
 	b, err := removeChunkExtension(b)
 	if err != nil {
 		return nil, 0, err
@@ -2,10 +2,12 @@ package http1
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,9 +16,18 @@ import (
 )
 
 var (
-	defalutServer = []byte("http1-server")
+	defalutServer   = []byte("http1-server")
+	chunkedEncoding = [][]byte{byteChunked}
 )
 
+// ErrInvalidHeaderField is returned by ResponseHeader.Set and Add for an empty key
+// or a key or value containing CR or LF, which would split the response
+var ErrInvalidHeaderField = errors.New("invalid response header field")
+
+// ErrServerHeaderField is returned by ResponseHeader.Set and Add for Content-Length,
+// Transfer-Encoding and Date, the server writes them from the response
+var ErrServerHeaderField = errors.New("response header field is written by the server")
+
 type ResponseHeader struct {
 	httparse.Response
 	ContentLength    int
@@ -25,6 +36,22 @@ type ResponseHeader struct {
 	HTTP11           bool
 	Server           []byte
 	ContentType      []byte
+
+	//hijacked responses hand the connection over and carry no body framing
+	hijacked bool
+
+	//headers keeps the fields added by Set and Add in insertion order,
+	//the key and value buffers are reused between responses
+	headers []headerField
+
+	//contentType and server hold the values given to Set and Add
+	contentType []byte
+	server      []byte
+}
+
+type headerField struct {
+	key   []byte
+	value []byte
 }
 
 func NewResponseHeader() *ResponseHeader {
@@ -41,11 +68,164 @@ func NewResponseHeader() *ResponseHeader {
 
 func (h *ResponseHeader) Reset() {
 	h.Response.Reset()
+	h.Proto = byteHTTP11
+	h.StatusCode = StatusOK
 	h.ContentLength = 0
+	h.TransferEncoding = nil
 	h.Close = false
-	h.HTTP11 = false
+	h.HTTP11 = true
 	//h.Server = nil
-	h.ContentType = nil
+	h.ContentType = defaultContentType
+	h.hijacked = false
+	h.headers = h.headers[:0]
+}
+
+// Set replaces all values of key with a copy of value, key is canonicalized.
+// Content-Type and Server update the matching fields and 'Connection: close' sets
+// Close, other Connection values are kept as fields. Content-Length,
+// Transfer-Encoding and Date are written by the server and rejected with
+// ErrServerHeaderField, CR or LF in key or value with ErrInvalidHeaderField
+func (h *ResponseHeader) Set(key string, value []byte) error {
+	if err := checkHeaderField(key, value); err != nil {
+		return err
+	}
+	if ok, err := h.setSpecial(key, value, true); ok {
+		return err
+	}
+	h.Del(key)
+	h.add(key, value)
+	return nil
+}
+
+// Add appends another value for key, repeated fields such as Set-Cookie
+// are written in the order they were added. It fails like Set
+func (h *ResponseHeader) Add(key string, value []byte) error {
+	if err := checkHeaderField(key, value); err != nil {
+		return err
+	}
+	if ok, err := h.setSpecial(key, value, false); ok {
+		return err
+	}
+	h.add(key, value)
+	return nil
+}
+
+func checkHeaderField(key string, value []byte) error {
+	if len(key) == 0 || strings.IndexAny(key, "\r\n:") >= 0 || bytes.IndexAny(value, "\r\n") >= 0 {
+		return errors.Wrapf(ErrInvalidHeaderField, "%q: %q", key, value)
+	}
+	return nil
+}
+
+func (h *ResponseHeader) add(key string, value []byte) {
+	n := len(h.headers)
+	if cap(h.headers) > n {
+		h.headers = h.headers[:n+1]
+	} else {
+		h.headers = append(h.headers, headerField{})
+	}
+	f := &h.headers[n]
+	f.key = appendCanonicalKey(f.key[:0], key)
+	f.value = append(f.value[:0], value...)
+}
+
+// setSpecial handles the keys kept outside the fields, it reports whether key was one of them
+func (h *ResponseHeader) setSpecial(key string, value []byte, replace bool) (bool, error) {
+	switch {
+	case equalFoldString(key, HeaderContentType):
+		h.contentType = append(h.contentType[:0], value...)
+		h.ContentType = h.contentType
+	case equalFoldString(key, HeaderServer):
+		h.server = append(h.server[:0], value...)
+		h.Server = h.server
+	case equalFoldString(key, HeaderConnection):
+		//other options such as Upgrade are sent as they were given
+		if !bytes.EqualFold(value, byteClose) {
+			return false, nil
+		}
+		if replace {
+			h.Del(key)
+		}
+		h.Close = true
+	case equalFoldString(key, HeaderContentLength),
+		equalFoldString(key, HeaderTransferEncoding),
+		equalFoldString(key, HeaderDate):
+		return true, errors.Wrap(ErrServerHeaderField, key)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Del removes all values of key
+func (h *ResponseHeader) Del(key string) {
+	switch {
+	case equalFoldString(key, HeaderContentType):
+		h.ContentType = nil
+		return
+	case equalFoldString(key, HeaderServer):
+		h.Server = nil
+		return
+	case equalFoldString(key, HeaderConnection):
+		h.Close = false
+	}
+	n := 0
+	for i := range h.headers {
+		if !equalFoldString(key, b2s(h.headers[i].key)) {
+			h.headers[n], h.headers[i] = h.headers[i], h.headers[n]
+			n++
+		}
+	}
+	h.headers = h.headers[:n]
+}
+
+// Peek returns the first value of key, the slice is valid until the response is reset
+func (h *ResponseHeader) Peek(key string) []byte {
+	switch {
+	case equalFoldString(key, HeaderContentType):
+		return h.ContentType
+	case equalFoldString(key, HeaderServer):
+		return h.Server
+	}
+	for i := range h.headers {
+		if equalFoldString(key, b2s(h.headers[i].key)) {
+			return h.headers[i].value
+		}
+	}
+	if h.Close && equalFoldString(key, HeaderConnection) {
+		return byteClose
+	}
+	return nil
+}
+
+// VisitAll calls f for every field added by Set and Add in the order they will be written
+func (h *ResponseHeader) VisitAll(f func(key, value []byte)) {
+	for i := range h.headers {
+		f(h.headers[i].key, h.headers[i].value)
+	}
+}
+
+// copyFieldsTo replaces the fields of dst with those added to h by Set and Add
+func (h *ResponseHeader) copyFieldsTo(dst *ResponseHeader) {
+	dst.headers = dst.headers[:0]
+	for i := range h.headers {
+		dst.add(b2s(h.headers[i].key), h.headers[i].value)
+	}
+}
+
+// SetHeader is Set, it keeps the httparse.Response method on the ordered storage
+func (h *ResponseHeader) SetHeader(key string, value []byte) error {
+	return h.Set(key, value)
+}
+
+// AddHeader is Add, it keeps the httparse.Response method on the ordered storage
+func (h *ResponseHeader) AddHeader(key string, value []byte) error {
+	return h.Add(key, value)
+}
+
+// GetHeader is Peek, it keeps the httparse.Response method on the ordered storage
+func (h *ResponseHeader) GetHeader(key string) []byte {
+	return h.Peek(key)
 }
 
 func (h *ResponseHeader) Write(w *bufio.Writer) error {
@@ -58,18 +238,36 @@ func (h *ResponseHeader) Write(w *bufio.Writer) error {
 		writeLine(w, byteServer, h.Server)
 	}
 
-	writeLine(w, byteDate, s2b(time.Now().Format(time.RFC850)))
+	writeLine(w, byteDate, currentDate())
+	if !h.hijacked {
+		h.writeFraming(w)
+	}
+
+	for i := range h.headers {
+		writeLine(w, h.headers[i].key, h.headers[i].value)
+	}
+
+	if h.Close {
+		writeLine(w, byteConnection, byteClose)
+	}
+
+	//end of header
+	w.Write(byteCRLF)
+	return nil
+}
+
+func (h *ResponseHeader) writeFraming(w *bufio.Writer) {
 	if h.ContentLength != 0 || len(h.ContentType) > 0 {
 		if len(h.ContentType) > 0 {
 			writeLine(w, byteContentType, h.ContentType)
 		}
 	}
-	if h.ContentLength > 0 && !h.mustIgnoreContentLength() {
+	if h.ContentLength >= 0 && !h.mustIgnoreContentLength() {
 		l := strconv.Itoa(h.ContentLength)
 		writeLine(w, byteContentLength, s2b(l))
 	}
 
-	if h.ContentLength == -1 && chunked(h.TransferEncoding) {
+	if h.ContentLength == -1 {
 		writeLine(w, byteTransferEncoding, byteChunked)
 	}
 
@@ -78,18 +276,6 @@ func (h *ResponseHeader) Write(w *bufio.Writer) error {
 		writeLine(w, byteTransferEncoding, byteIdentity)
 
 	}
-
-	for k, v := range h.Response.Headers {
-		writeLine(w, s2b(k), v[0])
-	}
-
-	if h.Close {
-		writeLine(w, byteConnection, byteClose)
-	}
-
-	//end of header
-	w.Write(byteCRLF)
-	return nil
 }
 
 func (h *ResponseHeader) SetContentLength(n int) {
@@ -102,16 +288,20 @@ func (h *ResponseHeader) SetContentLength(n int) {
 		return
 	}
 	h.ContentLength = n
-	delete(h.Response.Headers, HeaderTransferEncoding)
 }
 
-var responseBytePool bytebufferpool.Pool
+var responseBytePool bufferPool
 
 type Response struct {
 	header     ResponseHeader
 	body       *bytebufferpool.ByteBuffer
 	bodyStream io.Reader
+	bodyWriter func(w io.Writer) error
 	noBody     bool
+	//sent counts the body bytes written, chunk framing excluded
+	sent int64
+	//timing is sent as Server-Timing, in a trailer when the body is chunked
+	timing *ServerTiming
 }
 
 func NewResponse() *Response {
@@ -123,18 +313,24 @@ func NewResponse() *Response {
 func (r *Response) Reset() {
 	r.header.Reset()
 
-	//body is not need to reset see  (r *Response) ReadBody method
-	//if r.Body != nil {
-	//r.Body.Reset()
-	//responseBytePool.Put(r.Body)
-	//}
+	//the body buffer is kept for the next response on the connection
+	if r.body != nil {
+		r.body.Reset()
+	}
 	r.noBody = false
+	r.sent = 0
+	r.timing = nil
 	if r.bodyStream != nil {
 		if cl, ok := r.bodyStream.(io.Closer); ok {
 			cl.Close()
 		}
 		r.bodyStream = nil
 	}
+	r.bodyWriter = nil
+}
+
+func (r *Response) Header() *ResponseHeader {
+	return &r.header
 }
 
 func (r *Response) SetStatusCode(statusCode int) {
@@ -142,7 +338,7 @@ func (r *Response) SetStatusCode(statusCode int) {
 }
 
 func (r *Response) SetContentType(contentType []byte) {
-	r.header.ContentType = contentType
+	r.header.Set(HeaderContentType, contentType)
 }
 
 func (r *Response) SetClose(b bool) {
@@ -171,7 +367,7 @@ func (r *Response) Body() []byte {
 
 func (r *Response) BodyRelease() {
 	if r.body != nil {
-		requestBodyPool.Put(r.body)
+		responseBytePool.Put(r.body)
 		r.body = nil
 	}
 }
@@ -196,15 +392,39 @@ func (r *Response) SendFile(path string) error {
 	return nil
 }
 
+// SkipBody makes Write send the headers only, as for a HEAD request.
+// Content-Length still describes the body that would have been sent.
+func (r *Response) SkipBody(b bool) {
+	r.noBody = b
+}
+
+func (r *Response) SetLastModified(t time.Time) {
+	r.header.Set(HeaderLastModified, AppendHTTPDate(nil, t))
+}
+
+func (r *Response) SetExpires(t time.Time) {
+	r.header.Set(HeaderExpires, AppendHTTPDate(nil, t))
+}
+
 func (r *Response) SetBodyStream(reader io.Reader, size int) {
 	r.bodyStream = reader
 	r.header.ContentLength = size
 }
 
+// SetBodyStreamWriter sends the body chunked, fn is called once the headers are
+// written and each Write to w becomes a chunk. fn is skipped for HEAD responses
+func (r *Response) SetBodyStreamWriter(fn func(w io.Writer) error) {
+	r.bodyWriter = fn
+	r.header.ContentLength = -1
+}
+
 func (r *Response) Write(w *bufio.Writer) error {
 	if r.bodyStream != nil {
 		return r.writeBodyStream(w)
 	}
+	if r.bodyWriter != nil {
+		return r.writeBodyWriter(w)
+	}
 
 	hasBody := !r.noBody
 	var body []byte
@@ -215,6 +435,9 @@ func (r *Response) Write(w *bufio.Writer) error {
 			r.header.SetContentLength(bodyLen)
 		}
 	}
+	if r.timing != nil {
+		r.header.Set(HeaderServerTiming, r.timing.appendValue())
+	}
 	if err := r.header.Write(w); err != nil {
 		return err
 	}
@@ -223,6 +446,7 @@ func (r *Response) Write(w *bufio.Writer) error {
 		if _, err := w.Write(body); err != nil {
 			return err
 		}
+		r.sent = int64(len(body))
 	}
 	return nil
 }
@@ -245,28 +469,108 @@ func (r *Response) writeBodyStream(w *bufio.Writer) error {
 		}
 	}
 	if contentLength >= 0 {
-		if err = r.header.Write(w); err == nil {
-			_, err = bufCopy(w, r.bodyStream)
-			if err != nil {
-				return errors.WithStack(err)
+		if r.timing != nil {
+			r.header.Set(HeaderServerTiming, r.timing.appendValue())
+		}
+		if err = r.header.Write(w); err == nil && !r.noBody {
+			r.sent, err = bufCopy(w, r.bodyStream)
+			if err == nil && r.sent < int64(contentLength) {
+				//the client waits for the missing bytes, only closing the connection ends the response
+				err = io.ErrUnexpectedEOF
 			}
+			err = errors.WithStack(err)
 		}
 	} else {
+		//the size is unknown, a HEAD response advertises chunked framing like GET would
 		r.header.ContentLength = -1
-		if err = r.header.Write(w); err == nil {
-			err = writeChunked(w, r.bodyStream)
+		r.header.TransferEncoding = chunkedEncoding
+		r.announceTrailer()
+		if err = r.header.Write(w); err == nil && !r.noBody {
+			start := time.Now()
+			if r.sent, err = writeChunked(w, r.bodyStream); err == nil {
+				err = r.writeLastChunk(w, start)
+			}
 		}
 	}
-	if r.bodyStream == nil {
-		return nil
-	}
+	//the stream is closed even after a failed write, a proxied body frees its upstream connection
 	if cl, ok := r.bodyStream.(io.Closer); ok {
-		err = cl.Close()
+		if cerr := cl.Close(); err == nil {
+			err = cerr
+		}
 	}
 	r.bodyStream = nil
 	return err
 }
 
+func (r *Response) writeBodyWriter(w *bufio.Writer) error {
+	r.header.ContentLength = -1
+	r.header.TransferEncoding = chunkedEncoding
+	r.announceTrailer()
+	err := r.header.Write(w)
+	if err == nil && !r.noBody {
+		start := time.Now()
+		cw := chunkWriter{w: w}
+		err = r.bodyWriter(&cw)
+		r.sent = cw.n
+		if err == nil {
+			err = r.writeLastChunk(w, start)
+		}
+	}
+	r.bodyWriter = nil
+	return err
+}
+
+// chunkWriter frames every Write as a chunk, data is flushed when the
+// buffered writer fills up or Flush is called
+type chunkWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var b [16]byte
+	c.w.Write(strconv.AppendInt(b[:0], int64(len(p)), 16))
+	c.w.Write(byteCRLF)
+	c.w.Write(p)
+	if _, err := c.w.Write(byteCRLF); err != nil {
+		return 0, err
+	}
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func (c *chunkWriter) Flush() error {
+	return c.w.Flush()
+}
+
+// announceTrailer declares the Server-Timing trailer of a chunked body
+func (r *Response) announceTrailer() {
+	if r.timing == nil {
+		return
+	}
+	if r.noBody {
+		//no body is sent, so there is no trailer either
+		r.header.Set(HeaderServerTiming, r.timing.appendValue())
+	} else {
+		r.header.Set(HeaderTrailer, byteServerTiming)
+	}
+}
+
+// writeLastChunk ends a chunked body, Server-Timing goes in the trailer
+// with the time spent sending the body since start
+func (r *Response) writeLastChunk(w *bufio.Writer, start time.Time) error {
+	w.WriteString("0\r\n")
+	if r.timing != nil {
+		r.timing.Add(timingSend, time.Since(start), "")
+		writeLine(w, byteServerTiming, r.timing.appendValue())
+	}
+	w.Write(byteCRLF)
+	return w.Flush()
+}
+
 var responseBodyPool bytebufferpool.Pool
 
 func (h *ResponseHeader) mustIgnoreContentLength() bool {
@@ -0,0 +1,175 @@
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestResponseHeaderSetAddDel(t *testing.T) {
+	type field struct{ key, value string }
+	tests := []struct {
+		name string
+		edit func(h *ResponseHeader)
+		want []field
+	}{
+		{"canonical keys", func(h *ResponseHeader) {
+			h.Set("x-request-ID", []byte("1"))
+			h.Add("www-authenticate", []byte("Basic"))
+		}, []field{{"X-Request-Id", "1"}, {"Www-Authenticate", "Basic"}}},
+		{"repeated values keep their order", func(h *ResponseHeader) {
+			h.Add("Set-Cookie", []byte("a=1"))
+			h.Add("Link", []byte("</a>"))
+			h.Add("set-cookie", []byte("b=2"))
+		}, []field{{"Set-Cookie", "a=1"}, {"Link", "</a>"}, {"Set-Cookie", "b=2"}}},
+		{"set replaces every value", func(h *ResponseHeader) {
+			h.Add("Vary", []byte("Origin"))
+			h.Add("Vary", []byte("Accept"))
+			h.Set("VARY", []byte("*"))
+		}, []field{{"Vary", "*"}}},
+		{"del", func(h *ResponseHeader) {
+			h.Add("A", []byte("1"))
+			h.Add("B", []byte("2"))
+			h.Add("a", []byte("3"))
+			h.Del("A")
+		}, []field{{"B", "2"}}},
+		{"framing headers are rejected", func(h *ResponseHeader) {
+			h.Set("Content-Length", []byte("99"))
+			h.Add("transfer-encoding", []byte("chunked"))
+			h.Set("Date", []byte("never"))
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewResponseHeader()
+			tt.edit(h)
+			var got []field
+			h.VisitAll(func(k, v []byte) { got = append(got, field{string(k), string(v)}) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fields %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderSpecialFields(t *testing.T) {
+	h := NewResponseHeader()
+	ct, server := []byte("application/json"), []byte("x")
+	h.Set("content-type", ct)
+	h.Set("Server", server)
+	h.Set("Connection", []byte("Close"))
+	//the values are copied, the caller may reuse its buffers
+	ct[0], server[0] = 'X', 'X'
+	if string(h.Peek(HeaderContentType)) != "application/json" || string(h.Peek("server")) != "x" || !h.Close {
+		t.Errorf("special fields not applied: %q %q %v", h.ContentType, h.Server, h.Close)
+	}
+	if string(h.Peek(HeaderConnection)) != "close" {
+		t.Errorf("Connection %q", h.Peek(HeaderConnection))
+	}
+	h.Del(HeaderServer)
+	if h.Peek(HeaderServer) != nil {
+		t.Error("Server not deleted")
+	}
+	h.Del(HeaderConnection)
+	if h.Close || h.Peek(HeaderConnection) != nil {
+		t.Error("Connection not deleted")
+	}
+}
+
+func TestResponseHeaderErrors(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"X-A", "1", nil},
+		{"Content-Length", "99", ErrServerHeaderField},
+		{"transfer-encoding", "chunked", ErrServerHeaderField},
+		{"Date", "never", ErrServerHeaderField},
+		{"X-A", "1\r\nSet-Cookie: a=b", ErrInvalidHeaderField},
+		{"X-A", "1\nb", ErrInvalidHeaderField},
+		{"X-A\r\nSet-Cookie", "a=b", ErrInvalidHeaderField},
+		{"X-A: b", "c", ErrInvalidHeaderField},
+		{"", "v", ErrInvalidHeaderField},
+		{"Content-Type", "text/html\r\nX: y", ErrInvalidHeaderField},
+	}
+	for _, tt := range tests {
+		h := NewResponseHeader()
+		errSet := h.Set(tt.key, []byte(tt.value))
+		errAdd := h.Add(tt.key, []byte(tt.value))
+		if errors.Cause(errSet) != tt.err || errors.Cause(errAdd) != tt.err {
+			t.Errorf("%q: %q: Set %v, Add %v, want %v", tt.key, tt.value, errSet, errAdd, tt.err)
+		}
+		if tt.err != nil && (len(h.headers) != 0 || string(h.ContentType) != string(defaultContentType)) {
+			t.Errorf("%q: %q: rejected field stored", tt.key, tt.value)
+		}
+	}
+}
+
+func TestResponseHeaderConnection(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(h *ResponseHeader)
+		want string
+	}{
+		{"upgrade", func(h *ResponseHeader) {
+			h.StatusCode = StatusSwitchingProtocols
+			h.Set("Connection", []byte("Upgrade"))
+			h.Set("Upgrade", []byte("websocket"))
+		}, "Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n"},
+		{"close", func(h *ResponseHeader) { h.Set("Connection", []byte("close")) }, "Content-Length: 0\r\nConnection: close\r\n\r\n"},
+		{"set replaces close", func(h *ResponseHeader) {
+			h.Set("Connection", []byte("close"))
+			h.Set("Connection", []byte("keep-alive"))
+		}, "Content-Length: 0\r\nConnection: keep-alive\r\n\r\n"},
+		{"set replaces options", func(h *ResponseHeader) {
+			h.Add("Connection", []byte("Upgrade"))
+			h.Set("Connection", []byte("close"))
+		}, "Content-Length: 0\r\nConnection: close\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		h := NewResponseHeader()
+		tt.edit(h)
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		h.Write(w)
+		w.Flush()
+		if out := buf.String(); !strings.HasSuffix(out, tt.want) || strings.Count(out, "Connection") != 1 {
+			t.Errorf("%s: %q", tt.name, out)
+		}
+	}
+}
+
+func TestResponseHeaderWrite(t *testing.T) {
+	h := NewResponseHeader()
+	h.Add("Set-Cookie", []byte("a=1"))
+	h.Add("Set-Cookie", []byte("b=2"))
+	h.ContentLength = 2
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	h.Write(w)
+	w.Flush()
+	out := buf.String()
+	if !strings.Contains(out, "\r\nContent-Length: 2\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n") {
+		t.Errorf("unexpected header %q", out)
+	}
+
+	//the buffers are reused once the header is reset
+	h.Reset()
+	h.Add("X-A", []byte("1"))
+	if got := string(h.Peek("x-a")); got != "1" || len(h.headers) != 1 {
+		t.Errorf("after Reset: %q, %d fields", got, len(h.headers))
+	}
+	cookie, foo := []byte("a=1"), []byte("bar")
+	if n := testing.AllocsPerRun(100, func() {
+		h.Reset()
+		h.Add("Set-Cookie", cookie)
+		h.Set("X-Foo", foo)
+	}); n > 0 {
+		t.Errorf("Reset/Add/Set allocate %v times", n)
+	}
+}
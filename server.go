@@ -1,9 +1,66 @@
 package http1
 
+import (
+	"context"
+	"log"
+	"time"
+)
+
 type HandlerFunc func(ctx *Context)
 type Server struct {
-	Handler              HandlerFunc
+	Handler HandlerFunc
+	//MaxServeTimesPerConn closes a connection with the response to that many requests,
+	//0 means no limit
 	MaxServeTimesPerConn uint64
+
+	//HeadAsGet presents HEAD requests to Handler as GET,
+	//the response body is still suppressed
+	HeadAsGet bool
+
+	//HeaderHandler runs once the request headers are parsed, before Expect is answered
+	//and the body is read. It returns false to send the response it prepared
+	//and close the connection
+	HeaderHandler func(ctx *Context) bool
+
+	//ContinueHandler decides on 'Expect: 100-continue' after the headers are parsed.
+	//It returns false to refuse the body, the response it prepared (417 by default)
+	//is sent and the connection is closed
+	ContinueHandler func(ctx *Context) bool
+
+	//ErrorHandler prepares the response for a request that failed to parse,
+	//the status is already set from err.Status. The connection is closed after it is sent
+	ErrorHandler func(ctx *Context, err *ParseError)
+
+	Limits Limits
+
+	//TrustedProxies are the peers whose forwarding headers Context.RealIP believes
+	TrustedProxies *TrustedProxies
+
+	//AccessLog records every response once it is written
+	AccessLog *AccessLogger
+
+	//Metrics counts requests, connections and errors, see Metrics.Handler
+	Metrics *Metrics
+
+	//PanicHandler prepares the response for a request whose handler panicked with v,
+	//the status is already 500. The connection is closed after it is sent
+	PanicHandler func(ctx *Context, v interface{})
+
+	//BaseContext is the parent of every Context.Context, cancelling it
+	//cancels the requests in flight, as on shutdown
+	BaseContext context.Context
+
+	//RequestTimeout is the deadline of Context.Context, counted from the first byte of the request
+	RequestTimeout time.Duration
+
+	//ErrorLog receives panics recovered while serving, the log package's standard logger when nil
+	ErrorLog *log.Logger
+
+	//ServerTiming sends Context.ServerTiming with header, body and handler durations
+	//added, as a trailer when the body is chunked
+	ServerTiming bool
+	//ServerTimingAllowed limits ServerTiming to trusted clients, nil allows every client
+	ServerTimingAllowed func(ctx *Context) bool
 }
 
 func NewServer(handler HandlerFunc, maxServeTimesPerConn uint64) *Server {
@@ -12,3 +69,11 @@ func NewServer(handler HandlerFunc, maxServeTimesPerConn uint64) *Server {
 		MaxServeTimesPerConn: maxServeTimesPerConn,
 	}
 }
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
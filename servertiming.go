@@ -0,0 +1,117 @@
+package http1
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var byteServerTiming = []byte(HeaderServerTiming)
+
+// names of the entries added when Server.ServerTiming is set
+const (
+	timingHeader  = "header"
+	timingBody    = "body"
+	timingHandler = "handler"
+	timingSend    = "send"
+)
+
+// ServerTiming collects the metrics of the Server-Timing response header
+type ServerTiming struct {
+	entries []timingEntry
+	buf     []byte
+}
+
+type timingEntry struct {
+	name string
+	desc string
+	dur  time.Duration
+}
+
+// Add records d under name, desc is optional. name must be an HTTP token, an entry
+// with any other name is dropped so it can't split or end the header
+func (t *ServerTiming) Add(name string, d time.Duration, desc string) {
+	if !validTimingName(name) {
+		return
+	}
+	t.entries = append(t.entries, timingEntry{name: name, dur: d, desc: desc})
+}
+
+// Since records the time passed since start under name
+func (t *ServerTiming) Since(name string, start time.Time, desc string) {
+	t.Add(name, time.Since(start), desc)
+}
+
+// validTimingName reports whether name is a token as defined by RFC 7230
+func validTimingName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *ServerTiming) reset() {
+	for i := range t.entries {
+		t.entries[i] = timingEntry{}
+	}
+	t.entries = t.entries[:0]
+}
+
+// appendValue formats the entries as 'name;dur=1.234;desc="..."' in milliseconds,
+// the slice is reused by the next call
+func (t *ServerTiming) appendValue() []byte {
+	b := t.buf[:0]
+	for i := range t.entries {
+		e := &t.entries[i]
+		if i > 0 {
+			b = append(b, byteCommaSpace...)
+		}
+		b = append(b, e.name...)
+		b = append(b, ";dur="...)
+		b = strconv.AppendFloat(b, float64(e.dur)/float64(time.Millisecond), 'f', 3, 64)
+		if e.desc != "" {
+			b = append(b, `;desc="`...)
+			for j := 0; j < len(e.desc); j++ {
+				c := e.desc[j]
+				if c == '"' || c == '\\' {
+					b = append(b, '\\')
+				}
+				if c < 0x20 || c == 0x7f {
+					c = ' '
+				}
+				b = append(b, c)
+			}
+			b = append(b, '"')
+		}
+	}
+	t.buf = b
+	return b
+}
+
+// ServerTiming returns the collector of the current request, its entries are only
+// sent when Server.ServerTiming is set and Server.ServerTimingAllowed agrees
+func (ctx *Context) ServerTiming() *ServerTiming {
+	return &ctx.timing
+}
+
+// addServerTiming adds the phase entries and hands the collector to the response
+func (ctx *Context) addServerTiming(handlerStart, handlerEnd time.Time) {
+	if ctx.s.ServerTimingAllowed != nil && !ctx.s.ServerTimingAllowed(ctx) {
+		return
+	}
+	t := &ctx.timing
+	n := len(t.entries)
+	t.entries = append(t.entries, timingEntry{}, timingEntry{}, timingEntry{})
+	//the phases come first, then what the handler added
+	copy(t.entries[3:], t.entries[:n])
+	t.entries[0] = timingEntry{name: timingHeader, dur: ctx.headerParsed.Sub(ctx.start)}
+	t.entries[1] = timingEntry{name: timingBody, dur: ctx.bodyRead.Sub(ctx.headerParsed)}
+	t.entries[2] = timingEntry{name: timingHandler, dur: handlerEnd.Sub(handlerStart)}
+	ctx.resp.timing = t
+}
@@ -0,0 +1,88 @@
+package http1
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTimingAppendValue(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(st *ServerTiming)
+		want string
+	}{
+		{"empty", func(st *ServerTiming) {}, ""},
+		{"entries", func(st *ServerTiming) {
+			st.Add("db", 1500*time.Microsecond, "")
+			st.Add("cache", 0, "miss")
+		}, `db;dur=1.500, cache;dur=0.000;desc="miss"`},
+		{"escaped desc", func(st *ServerTiming) { st.Add("a", time.Millisecond, "q\"b\\\r\nx") },
+			`a;dur=1.000;desc="q\"b\\  x"`},
+		{"header injection", func(st *ServerTiming) { st.Add("db\r\nSet-Cookie: a=b", time.Millisecond, "") }, ""},
+		{"invalid names dropped", func(st *ServerTiming) {
+			for _, name := range []string{"", "a b", "a;dur=9", "a,b", `"a"`, "é", "a\x7f"} {
+				st.Add(name, time.Millisecond, "")
+			}
+			st.Add("ok.1_~!#$%&'*+-^`|", time.Millisecond, "")
+		}, "ok.1_~!#$%&'*+-^`|;dur=1.000"},
+	}
+	for _, tt := range tests {
+		var st ServerTiming
+		tt.add(&st)
+		if got := string(st.appendValue()); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	entry := `[a-z]+;dur=\d+\.\d{3}`
+	tests := []struct {
+		name    string
+		allowed bool
+		method  string
+		stream  bool
+		header  string
+		trailer string
+	}{
+		{"header", true, "GET", false, `^header;dur=\S+, body;dur=\S+, handler;dur=\S+, db;dur=2\.000;desc="q"$`, ""},
+		{"head", true, "HEAD", true, `^(` + entry + `, ){3}db;dur=2\.000;desc="q"$`, ""},
+		{"chunked trailer", true, "GET", true, "", `^(` + entry + `, ){3}db;dur=2\.000;desc="q", send;dur=\S+$`},
+		{"not allowed", false, "GET", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(func(ctx *Context) {
+				ctx.ServerTiming().Add("db", 2*time.Millisecond, "q")
+				ctx.ServerTiming().Add("x\r\nX-Injected: 1", time.Millisecond, "")
+				if tt.stream {
+					ctx.Response().SetBodyStreamWriter(func(w io.Writer) error {
+						_, err := io.WriteString(w, "hello")
+						return err
+					})
+				} else {
+					ctx.Response().SetBody([]byte("hello"))
+				}
+			}, 0)
+			s.ServerTiming = true
+			s.ServerTimingAllowed = func(ctx *Context) bool { return tt.allowed }
+			out, _ := serveString(s, tt.method+" / HTTP/1.1\r\nHost: a\r\n\r\n")
+			if strings.Contains(out, "X-Injected") {
+				t.Fatalf("header injected: %q", out)
+			}
+			resp := readResponses(t, out, tt.method)[0]
+			if body := readBody(resp); tt.method == "GET" && body != "hello" {
+				t.Errorf("body %q", body)
+			}
+			if v := resp.Header.Get(HeaderServerTiming); tt.header == "" && v != "" || tt.header != "" && !regexp.MustCompile(tt.header).MatchString(v) {
+				t.Errorf("header %q, want %q", v, tt.header)
+			}
+			if v := resp.Trailer.Get(HeaderServerTiming); tt.trailer == "" && v != "" || tt.trailer != "" && !regexp.MustCompile(tt.trailer).MatchString(v) {
+				t.Errorf("trailer %q, want %q", v, tt.trailer)
+			}
+		})
+	}
+}
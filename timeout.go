@@ -0,0 +1,156 @@
+package http1
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errDetachedConn = errors.New("connection is not available to a timed out handler")
+
+// HandlerTimeout runs the handler on its own goroutine and answers Status once
+// Timeout passes without it returning. The handler sees a copy of the request and
+// works on a Response that is given back only if it finishes in time, so writes
+// after the deadline never reach the connection or the next keep-alive request.
+// Its Context.Context is cancelled at the deadline. User values set before the
+// deadline are handed to a handler that times out, they are closed once it returns
+type HandlerTimeout struct {
+	Timeout time.Duration
+	//Status is 503 by default, 504 suits handlers waiting on an upstream
+	Status int
+	//Body defaults to the status reason
+	Body []byte
+}
+
+func NewHandlerTimeout(timeout time.Duration) *HandlerTimeout {
+	return &HandlerTimeout{Timeout: timeout, Status: StatusServiceUnavailable}
+}
+
+var timeoutContextPool sync.Pool
+
+func (t *HandlerTimeout) Middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		sh := acquireTimeoutContext(ctx)
+		//the handler gets the real response, ctx keeps the spare for the fallback
+		//with the headers outer middleware set so far
+		ctx.resp.header.copyFieldsTo(&sh.resp.header)
+		sh.resp, ctx.resp = ctx.resp, sh.resp
+		c, cancel := context.WithTimeout(ctx.Context(), t.Timeout)
+		sh.reqCtx, sh.cancel = c, cancel
+
+		done := make(chan struct{})
+		var panicked interface{}
+		var stack []byte
+		go func() {
+			defer func() {
+				if panicked = recover(); panicked != nil {
+					stack = debug.Stack()
+				}
+				close(done)
+			}()
+			next(sh)
+		}()
+
+		timer := time.NewTimer(t.Timeout)
+		select {
+		case <-done:
+			timer.Stop()
+			ctx.resp, sh.resp = sh.resp, ctx.resp
+			ctx.hijack, sh.hijack = sh.hijack, nil
+			ctx.hijackNoResp = sh.hijackNoResp
+			ctx.authUser = sh.authUser
+			ctx.span = sh.span
+			ctx.userValues = append(ctx.userValues[:0], sh.userValues...)
+			ctx.timing.entries = append(ctx.timing.entries[:0], sh.timing.entries...)
+			releaseTimeoutContext(sh)
+			if panicked != nil {
+				//recovered again by ServeHttp, which answers 500
+				panic(panicked)
+			}
+		case <-timer.C:
+			cancel()
+			t.fallback(ctx)
+			//the abandoned handler owns sh, the response it was given and a span a tracer
+			//inside it started until it returns, that span is never exported.
+			//It owns the user values as well, ctx must not close them when it is reset
+			ctx.dropUserValues()
+			go func() {
+				<-done
+				if panicked != nil {
+					sh.s.logf("http1: panic in timed out handler: %v\n%s", panicked, stack)
+				}
+				sh.resetUserValues()
+				releaseTimeoutContext(sh)
+			}()
+		}
+	}
+}
+
+func (t *HandlerTimeout) fallback(ctx *Context) {
+	status := t.Status
+	if status == 0 {
+		status = StatusServiceUnavailable
+	}
+	ctx.resp.SetStatusCode(status)
+	ctx.resp.SkipBody(ctx.head)
+	if len(t.Body) > 0 {
+		ctx.resp.SetBody(t.Body)
+	} else {
+		ctx.resp.SetBody(s2b(reason(status)))
+	}
+}
+
+// acquireTimeoutContext returns a Context detached from the connection holding
+// a copy of the request of ctx
+func acquireTimeoutContext(ctx *Context) *Context {
+	v := timeoutContextPool.Get()
+	var sh *Context
+	if v == nil {
+		sh = &Context{req: NewRequst(""), resp: NewResponse()}
+	} else {
+		sh = v.(*Context)
+	}
+	ctx.req.copyTo(sh.req)
+	sh.s = ctx.s
+	sh.conn = &detachedConn{addr: ctx.RemoteAddr()}
+	sh.connRequestNum = ctx.connRequestNum
+	sh.head = ctx.head
+	sh.authUser = ctx.authUser
+	sh.start = ctx.start
+	sh.headerParsed = ctx.headerParsed
+	sh.bodyRead = ctx.bodyRead
+	sh.span = ctx.span
+	sh.userValues = append(sh.userValues[:0], ctx.userValues...)
+	sh.resp.SkipBody(ctx.head)
+	return sh
+}
+
+func releaseTimeoutContext(sh *Context) {
+	sh.cancelRequest()
+	sh.closeHijack()
+	sh.resp.Reset()
+	sh.req.Reset()
+	sh.client.reset()
+	sh.dropUserValues()
+	sh.timing.reset()
+	sh.s, sh.conn, sh.span = nil, nil, nil
+	sh.authUser = ""
+	timeoutContextPool.Put(sh)
+}
+
+// detachedConn stands in for the connection of a timed out handler,
+// only the remote address is kept
+type detachedConn struct {
+	addr net.Addr
+}
+
+func (c *detachedConn) Bytes() ([]byte, error)      { return nil, errDetachedConn }
+func (c *detachedConn) Shift(n int)                 {}
+func (c *detachedConn) Buffered() int               { return 0 }
+func (c *detachedConn) Write(p []byte) (int, error) { return 0, errDetachedConn }
+func (c *detachedConn) RemoteAddr() net.Addr        { return c.addr }
+func (c *detachedConn) Close() error                { return nil }
@@ -0,0 +1,194 @@
+package http1
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// timeoutTestHandler answers /fast right away, /slow after the context is
+// cancelled and /panic with a panic. Late writes are signalled on late
+func timeoutTestHandler(late *sync.WaitGroup) HandlerFunc {
+	return func(ctx *Context) {
+		switch string(ctx.Request().URI().Path()) {
+		case "/slow":
+			late.Add(1)
+			defer late.Done()
+			<-ctx.Context().Done()
+			time.Sleep(10 * time.Millisecond)
+			ctx.Response().SetBody([]byte("late"))
+			ctx.Response().Header().Set("X-Late", []byte("1"))
+			ctx.SetUserValue(testKey{}, "late")
+		case "/panic":
+			panic("p")
+		default:
+			ctx.SetUserValue(testKey{}, "fast")
+			ctx.Response().Header().Set("X-Inner", []byte("1"))
+			ctx.Response().SetBody(append([]byte("fast "), ctx.Request().Header().UserAgent()...))
+		}
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout *HandlerTimeout
+		method  string
+		path    string
+		status  int
+		body    string
+		inner   bool
+	}{
+		{"fast", NewHandlerTimeout(time.Second), "GET", "/fast", StatusOK, "fast ua", true},
+		{"slow", NewHandlerTimeout(20 * time.Millisecond), "GET", "/slow", StatusServiceUnavailable, "Service Unavailable", false},
+		{"slow head", NewHandlerTimeout(20 * time.Millisecond), "HEAD", "/slow", StatusServiceUnavailable, "", false},
+		{"custom fallback", &HandlerTimeout{Timeout: 20 * time.Millisecond, Status: StatusGatewayTimeout, Body: []byte("upstream")},
+			"GET", "/slow", StatusGatewayTimeout, "upstream", false},
+		{"zero status", &HandlerTimeout{Timeout: 20 * time.Millisecond}, "GET", "/slow", StatusServiceUnavailable, "Service Unavailable", false},
+		{"panic", NewHandlerTimeout(time.Second), "GET", "/panic", StatusInternalServerError, "Internal Server Error", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var late sync.WaitGroup
+			var value interface{}
+			mem := &MemoryExporter{}
+			cors := CORS(CORSConfig{AllowOrigins: []string{"https://a.com"}})
+			outer := func(next HandlerFunc) HandlerFunc {
+				return func(ctx *Context) {
+					next(ctx)
+					value = ctx.UserValue(testKey{})
+				}
+			}
+			s := NewServer(Chain(timeoutTestHandler(&late), NewTracer(mem).Middleware, cors, outer, tt.timeout.Middleware), 0)
+			//the next request on the connection must not see what the first handler does late
+			out, _ := serveString(s, tt.method+" "+tt.path+" HTTP/1.1\r\nHost: a\r\nOrigin: https://a.com\r\nUser-Agent: ua\r\n\r\n"+
+				"GET /next HTTP/1.1\r\nHost: a\r\n\r\n")
+			late.Wait()
+			methods := []string{tt.method, "GET"}
+			if tt.status == StatusInternalServerError {
+				methods = methods[:1]
+			}
+			resps := readResponses(t, out, methods...)
+			resp := resps[0]
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if body := readBody(resp); body != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+			//a panic is answered by ServeHttp with a fresh response, as without a timeout
+			if tt.status != StatusInternalServerError && (resp.Header.Get(HeaderXRequestID) == "" ||
+				resp.Header.Get(HeaderAccessControlAllowOrigin) != "https://a.com" || resp.Header.Get(HeaderVary) != "Origin") {
+				t.Errorf("headers of outer middleware lost: %v", resp.Header)
+			}
+			if (resp.Header.Get("X-Inner") != "") != tt.inner || resp.Header.Get("X-Late") != "" {
+				t.Errorf("headers of the handler: %v", resp.Header)
+			}
+			if len(resps) > 1 {
+				if next := resps[1]; next.StatusCode != StatusOK || next.Header.Get("X-Late") != "" || readBody(next) != "fast " {
+					t.Errorf("next response %d %v", next.StatusCode, next.Header)
+				}
+			}
+			if tt.inner && value != "fast" {
+				t.Errorf("user value %v", value)
+			}
+			if spans := mem.Spans(); len(spans) != len(methods) || spans[0].StatusCode != tt.status {
+				t.Errorf("%d spans exported", len(spans))
+			}
+		})
+	}
+}
+
+func TestHandlerTimeoutInnerTracer(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		exported int
+	}{
+		{"in time", "/fast", 1},
+		//the span of the abandoned handler is still written to, it must not be exported
+		{"timed out", "/slow", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var late sync.WaitGroup
+			mem := &MemoryExporter{}
+			to := NewHandlerTimeout(20 * time.Millisecond)
+			s := NewServer(Chain(timeoutTestHandler(&late), to.Middleware, NewTracer(mem).Middleware), 0)
+			out, _ := serveString(s, "GET "+tt.path+" HTTP/1.1\r\nHost: a\r\n\r\n")
+			late.Wait()
+			readResponses(t, out, "GET")
+			spans := mem.Spans()
+			if len(spans) != tt.exported {
+				t.Fatalf("%d spans exported, want %d", len(spans), tt.exported)
+			}
+			if tt.exported > 0 && (spans[0].HandlerEnd.IsZero() || spans[0].Flushed.IsZero() || !strings.HasPrefix(spans[0].Name, "GET")) {
+				t.Errorf("span %+v", spans[0])
+			}
+		})
+	}
+}
+
+// signalCloser counts Close calls and reports each on closed
+type signalCloser struct {
+	n      int32
+	closed chan struct{}
+}
+
+func (c *signalCloser) Close() error {
+	atomic.AddInt32(&c.n, 1)
+	c.closed <- struct{}{}
+	return nil
+}
+
+func TestHandlerTimeoutUserValues(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"in time", "/fast"},
+		//the timed out handler keeps using the values after the request is released
+		{"timed out", "/slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := &signalCloser{closed: make(chan struct{}, 2)}
+			late := &signalCloser{closed: make(chan struct{}, 2)}
+			released := make(chan struct{})
+			var closedInHandler int32 = -1
+			handler := func(ctx *Context) {
+				if tt.path == "/slow" {
+					<-ctx.Context().Done()
+					<-released
+					closedInHandler = atomic.LoadInt32(&shared.n)
+				}
+				ctx.SetUserValue(testKey{}, late)
+			}
+			outer := func(next HandlerFunc) HandlerFunc {
+				return func(ctx *Context) {
+					ctx.SetUserValue(signalCloser{}, shared)
+					next(ctx)
+				}
+			}
+			s := NewServer(Chain(handler, outer, NewHandlerTimeout(20*time.Millisecond).Middleware), 0)
+			serveString(s, "GET "+tt.path+" HTTP/1.1\r\nHost: a\r\n\r\n")
+			close(released)
+			for _, c := range []*signalCloser{shared, late} {
+				select {
+				case <-c.closed:
+				case <-time.After(time.Second):
+					t.Fatal("user value not closed")
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if n, m := atomic.LoadInt32(&shared.n), atomic.LoadInt32(&late.n); n != 1 || m != 1 {
+				t.Errorf("values closed %d and %d times, want once", n, m)
+			}
+			if tt.path == "/slow" && closedInHandler != 0 {
+				t.Errorf("value closed %d times while the handler ran", closedInHandler)
+			}
+		})
+	}
+}
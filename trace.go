@@ -0,0 +1,387 @@
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	traceparentLen  = 55
+	maxTraceMembers = 32
+	maxRequestIDLen = 128
+)
+
+const (
+	// SpanKindServer is the OTLP kind of the spans Tracer records
+	SpanKindServer = 2
+
+	spanStatusError = 2
+)
+
+// Span is the server side of a request in a W3C trace, the timings are zero until reached
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte //zero when the request started the trace
+	Flags        byte
+	TraceState   string
+	RequestID    string
+
+	Name       string
+	Method     string
+	Target     string
+	RemoteAddr string
+	StatusCode int
+
+	Start        time.Time
+	HeaderParsed time.Time
+	HandlerStart time.Time
+	HandlerEnd   time.Time
+	Flushed      time.Time
+
+	tracer *Tracer
+}
+
+// Sampled reports whether the sampled flag of the trace is set
+func (s *Span) Sampled() bool {
+	return s.Flags&1 == 1
+}
+
+// AppendTraceparent appends the traceparent value naming s as the parent,
+// to propagate the trace to outgoing requests
+func (s *Span) AppendTraceparent(dst []byte) []byte {
+	dst = append(dst, "00-"...)
+	dst = appendHex(dst, s.TraceID[:])
+	dst = append(dst, '-')
+	dst = appendHex(dst, s.SpanID[:])
+	dst = append(dst, '-')
+	return appendHex(dst, []byte{s.Flags})
+}
+
+// Span returns the span Tracer started for the request, nil without one
+func (ctx *Context) Span() *Span {
+	return ctx.span
+}
+
+// SpanExporter receives the spans of finished requests, it owns them
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// Tracer continues the trace of a valid traceparent header or starts a new one,
+// and echoes X-Request-ID, generating one when the client sent none
+type Tracer struct {
+	Exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+// Middleware starts the span of the request and records the handler timings,
+// the span is exported once the response is written
+func (t *Tracer) Middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) {
+		s := t.startSpan(ctx)
+		ctx.span = s
+		ctx.resp.header.Set(HeaderXRequestID, s2b(s.RequestID))
+		s.HandlerStart = time.Now()
+		next(ctx)
+		s.HandlerEnd = time.Now()
+	}
+}
+
+func (t *Tracer) startSpan(ctx *Context) *Span {
+	s := &Span{
+		Method:       string(ctx.req.header.Method),
+		Target:       string(ctx.req.header.URI),
+		RemoteAddr:   remoteIP(ctx.RemoteAddr()),
+		Start:        ctx.start,
+		HeaderParsed: ctx.headerParsed,
+		tracer:       t,
+	}
+	if ctx.head {
+		s.Method = MethodHead
+	}
+	s.Name = s.Method + " " + string(ctx.req.uri.Path())
+	var ids [8 + 16]byte
+	rand.Read(ids[:])
+	copy(s.SpanID[:], ids[:8])
+	if parseTraceparent(ctx.req.header.GetHeader(HeaderTraceparent), s) {
+		if state := ctx.req.header.GetHeader(HeaderTracestate); validTracestate(state) {
+			s.TraceState = string(state)
+		}
+	} else {
+		copy(s.TraceID[:], ids[8:])
+		s.Flags = 1
+	}
+	if id := ctx.req.header.GetHeader(HeaderXRequestID); validRequestID(id) {
+		s.RequestID = string(id)
+	} else {
+		s.RequestID = hex.EncodeToString(ids[8:])
+	}
+	return s
+}
+
+func (ctx *Context) endSpan() {
+	s := ctx.span
+	s.Flushed = time.Now()
+	s.StatusCode = ctx.resp.header.StatusCode
+	if s.Sampled() && s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
+
+// parseTraceparent fills the trace id, parent id and flags of s from v,
+// s is left alone when v is invalid
+func parseTraceparent(v []byte, s *Span) bool {
+	if len(v) < traceparentLen || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return false
+	}
+	var version [1]byte
+	if !decodeLowerHex(version[:], v[:2]) || version[0] == 0xff {
+		return false
+	}
+	//version 00 has exactly four fields, later versions may append more
+	if len(v) > traceparentLen && (version[0] == 0 || v[traceparentLen] != '-') {
+		return false
+	}
+	var traceID [16]byte
+	var parentID [8]byte
+	var flags [1]byte
+	if !decodeLowerHex(traceID[:], v[3:35]) || !decodeLowerHex(parentID[:], v[36:52]) ||
+		!decodeLowerHex(flags[:], v[53:55]) || isZero(traceID[:]) || isZero(parentID[:]) {
+		return false
+	}
+	s.TraceID, s.ParentSpanID, s.Flags = traceID, parentID, flags[0]
+	return true
+}
+
+func decodeLowerHex(dst, src []byte) bool {
+	for _, c := range src {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	_, err := hex.Decode(dst, src)
+	return err == nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validTracestate checks the list-members of a tracestate header, an invalid
+// header is dropped as a whole
+func validTracestate(v []byte) bool {
+	if len(v) == 0 {
+		return false
+	}
+	members, ok := 0, true
+	eachListItem(v, func(m []byte) bool {
+		members++
+		eq := bytes.IndexByte(m, '=')
+		ok = members <= maxTraceMembers && eq > 0 &&
+			validTraceKey(m[:eq]) && validTraceValue(m[eq+1:])
+		return ok
+	})
+	return ok && members > 0
+}
+
+// validTraceKey accepts simple keys and multi-tenant keys, tenant@system
+func validTraceKey(k []byte) bool {
+	at := bytes.IndexByte(k, '@')
+	if at < 0 {
+		return len(k) <= 256 && isLowerAlpha(k[0]) && validTraceKeyChars(k)
+	}
+	tenant, system := k[:at], k[at+1:]
+	return len(tenant) > 0 && len(tenant) <= 241 && len(system) > 0 && len(system) <= 14 &&
+		(isLowerAlpha(tenant[0]) || isDigit(tenant[0])) && isLowerAlpha(system[0]) &&
+		validTraceKeyChars(tenant) && validTraceKeyChars(system)
+}
+
+func validTraceKeyChars(k []byte) bool {
+	for _, c := range k {
+		if !isLowerAlpha(c) && !isDigit(c) && c != '_' && c != '-' && c != '*' && c != '/' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func validTraceValue(v []byte) bool {
+	if len(v) == 0 || len(v) > 256 || v[len(v)-1] == ' ' {
+		return false
+	}
+	for _, c := range v {
+		if c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func validRequestID(v []byte) bool {
+	if len(v) == 0 || len(v) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range v {
+		if c <= 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func appendHex(dst, src []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	for _, c := range src {
+		dst = append(dst, hexDigits[c>>4], hexDigits[c&0xf])
+	}
+	return dst
+}
+
+// MemoryExporter keeps the exported spans, for tests
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *MemoryExporter) ExportSpan(s *Span) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+}
+
+// Spans returns the spans exported so far
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
+
+// OTLPJSONExporter writes every span as one OTLP/JSON ExportTraceServiceRequest per line,
+// the format of the OpenTelemetry collector file exporter
+type OTLPJSONExporter struct {
+	ServiceName string
+
+	mu  sync.Mutex
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+func NewOTLPJSONExporter(w io.Writer, serviceName string) *OTLPJSONExporter {
+	return &OTLPJSONExporter{ServiceName: serviceName, w: bufio.NewWriter(w)}
+}
+
+func (e *OTLPJSONExporter) ExportSpan(s *Span) {
+	e.mu.Lock()
+	e.buf = appendOTLPSpan(e.buf[:0], e.ServiceName, s)
+	if _, err := e.w.Write(e.buf); err != nil && e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
+
+// Flush writes the buffered spans, it returns the first write error
+func (e *OTLPJSONExporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.w.Flush(); err != nil && e.err == nil {
+		e.err = err
+	}
+	return e.err
+}
+
+func appendOTLPSpan(b []byte, service string, s *Span) []byte {
+	b = append(b, `{"resourceSpans":[{"resource":{"attributes":[`...)
+	b = appendOTLPAttr(b, "service.name", service)
+	b = append(b, `]},"scopeSpans":[{"scope":{"name":"http1"},"spans":[{"traceId":"`...)
+	b = appendHex(b, s.TraceID[:])
+	b = append(b, `","spanId":"`...)
+	b = appendHex(b, s.SpanID[:])
+	b = append(b, '"')
+	if !isZero(s.ParentSpanID[:]) {
+		b = append(b, `,"parentSpanId":"`...)
+		b = appendHex(b, s.ParentSpanID[:])
+		b = append(b, '"')
+	}
+	if s.TraceState != "" {
+		b = append(b, `,"traceState":`...)
+		b = appendJSONString(b, s2b(s.TraceState))
+	}
+	b = append(b, `,"name":`...)
+	b = appendJSONString(b, s2b(s.Name))
+	b = append(b, `,"kind":`...)
+	b = strconv.AppendInt(b, SpanKindServer, 10)
+	b = append(b, `,"startTimeUnixNano":"`...)
+	b = strconv.AppendInt(b, s.Start.UnixNano(), 10)
+	b = append(b, `","endTimeUnixNano":"`...)
+	b = strconv.AppendInt(b, s.Flushed.UnixNano(), 10)
+	b = append(b, `","attributes":[`...)
+	b = appendOTLPAttr(b, "http.request.method", s.Method)
+	b = append(b, ',')
+	b = appendOTLPAttr(b, "http.target", s.Target)
+	b = append(b, ',')
+	b = appendOTLPAttr(b, "client.address", s.RemoteAddr)
+	b = append(b, ',')
+	b = appendOTLPAttr(b, "http.request.id", s.RequestID)
+	b = append(b, `,{"key":"http.response.status_code","value":{"intValue":"`...)
+	b = strconv.AppendInt(b, int64(s.StatusCode), 10)
+	b = append(b, `"}}],"events":[`...)
+	b = appendOTLPEvent(b, "header_parsed", s.HeaderParsed)
+	b = append(b, ',')
+	b = appendOTLPEvent(b, "handler_start", s.HandlerStart)
+	b = append(b, ',')
+	b = appendOTLPEvent(b, "handler_end", s.HandlerEnd)
+	b = append(b, ',')
+	b = appendOTLPEvent(b, "response_flushed", s.Flushed)
+	b = append(b, `],"status":{`...)
+	if s.StatusCode >= 500 {
+		b = append(b, `"code":`...)
+		b = strconv.AppendInt(b, spanStatusError, 10)
+	}
+	return append(b, "}}]}]}]}\n"...)
+}
+
+func appendOTLPAttr(b []byte, key, value string) []byte {
+	b = append(b, `{"key":"`...)
+	b = append(b, key...)
+	b = append(b, `","value":{"stringValue":`...)
+	b = appendJSONString(b, s2b(value))
+	return append(b, "}}"...)
+}
+
+func appendOTLPEvent(b []byte, name string, t time.Time) []byte {
+	b = append(b, `{"timeUnixNano":"`...)
+	b = strconv.AppendInt(b, t.UnixNano(), 10)
+	b = append(b, `","name":"`...)
+	b = append(b, name...)
+	return append(b, `"}`...)
+}
@@ -0,0 +1,157 @@
+package http1
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const trace, parent = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		name  string
+		v     string
+		ok    bool
+		flags byte
+	}{
+		{"valid", "00-" + trace + "-" + parent + "-01", true, 1},
+		{"not sampled", "00-" + trace + "-" + parent + "-00", true, 0},
+		{"future version with more fields", "cc-" + trace + "-" + parent + "-09-extra", true, 9},
+		{"version 00 with more fields", "00-" + trace + "-" + parent + "-01-extra", false, 0},
+		{"future version glued field", "cc-" + trace + "-" + parent + "-01x", false, 0},
+		{"version ff", "ff-" + trace + "-" + parent + "-01", false, 0},
+		{"uppercase", "00-" + strings.ToUpper(trace) + "-" + parent + "-01", false, 0},
+		{"zero trace", "00-00000000000000000000000000000000-" + parent + "-01", false, 0},
+		{"zero parent", "00-" + trace + "-0000000000000000-01", false, 0},
+		{"bad flags", "00-" + trace + "-" + parent + "-0g", false, 0},
+		{"short", "00-" + trace + "-" + parent, false, 0},
+		{"bad separator", "00_" + trace + "-" + parent + "-01", false, 0},
+	}
+	for _, tt := range tests {
+		var s Span
+		ok := parseTraceparent([]byte(tt.v), &s)
+		if ok != tt.ok {
+			t.Errorf("%s: ok %v", tt.name, ok)
+			continue
+		}
+		if !ok {
+			if s != (Span{}) {
+				t.Errorf("%s: span changed by an invalid header: %+v", tt.name, s)
+			}
+			continue
+		}
+		if hex.EncodeToString(s.TraceID[:]) != trace || hex.EncodeToString(s.ParentSpanID[:]) != parent || s.Flags != tt.flags {
+			t.Errorf("%s: %x %x %x", tt.name, s.TraceID, s.ParentSpanID, s.Flags)
+		}
+	}
+}
+
+func TestValidTracestate(t *testing.T) {
+	tests := []struct {
+		v  string
+		ok bool
+	}{
+		{"congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", true},
+		{"tenant@sys=v, 1a@b=x", true},
+		{"", false},
+		{"Upper=v", false},
+		{"k=", false},
+		{"k=v=w", false},
+		{"@sys=v", false},
+		{"t@toolongsystemname=v", false},
+		{strings.Repeat("k=v,", maxTraceMembers) + "k=v", false},
+	}
+	for _, tt := range tests {
+		if ok := validTracestate([]byte(tt.v)); ok != tt.ok {
+			t.Errorf("validTracestate(%q) = %v", tt.v, ok)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name       string
+		header     string
+		exported   bool
+		continued  bool
+		traceState string
+		requestID  string
+	}{
+		{"continued", "Traceparent: " + traceparent + "\r\nTracestate: congo=t61,rojo@x=1\r\nX-Request-ID: abc\r\n", true, true, "congo=t61,rojo@x=1", "abc"},
+		{"invalid tracestate", "Traceparent: " + traceparent + "\r\nTracestate: Bad\r\n", true, true, "", ""},
+		{"new trace", "", true, false, "", ""},
+		{"invalid parent starts a root span", "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz\r\n", true, false, "", ""},
+		{"not sampled", "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n", false, true, "", ""},
+		{"invalid request id", "X-Request-ID: a b\r\n", true, false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := &MemoryExporter{}
+			var inHandler *Span
+			s := NewServer(Chain(func(ctx *Context) {
+				inHandler = ctx.Span()
+				ctx.Response().SetBody(ctx.Span().AppendTraceparent(nil))
+			}, NewTracer(mem).Middleware), 0)
+			out, _ := serveString(s, "GET /p?q HTTP/1.1\r\nHost: a\r\n"+tt.header+"\r\n")
+			resp := readResponses(t, out, "GET")[0]
+			sp := inHandler
+			if sp == nil {
+				t.Fatal("no span in the handler")
+			}
+			if spans := mem.Spans(); (len(spans) == 1) != tt.exported || tt.exported && spans[0] != sp {
+				t.Fatalf("exported %d spans", len(spans))
+			}
+			if continued := hex.EncodeToString(sp.TraceID[:]) == "4bf92f3577b34da6a3ce929d0e0e4736"; continued != tt.continued {
+				t.Errorf("trace continued %v", continued)
+			}
+			if !tt.continued && !isZero(sp.ParentSpanID[:]) {
+				t.Errorf("root span has parent %x", sp.ParentSpanID)
+			}
+			if sp.TraceState != tt.traceState {
+				t.Errorf("tracestate %q", sp.TraceState)
+			}
+			id := resp.Header.Get(HeaderXRequestID)
+			if id != sp.RequestID || tt.requestID != "" && id != tt.requestID || len(id) == 0 {
+				t.Errorf("request id %q, span %q", id, sp.RequestID)
+			}
+			if body := readBody(resp); body != string(sp.AppendTraceparent(nil)) || !strings.Contains(body, hex.EncodeToString(sp.SpanID[:])) {
+				t.Errorf("traceparent %q", body)
+			}
+			if sp.Name != "GET /p" || sp.StatusCode != StatusOK || sp.HandlerEnd.Before(sp.HandlerStart) || sp.Flushed.Before(sp.HandlerEnd) {
+				t.Errorf("span %+v", sp)
+			}
+		})
+	}
+}
+
+func TestOTLPJSONExporter(t *testing.T) {
+	var b bytes.Buffer
+	ex := NewOTLPJSONExporter(&b, "svc")
+	root := &Span{Name: "GET /", StatusCode: 503, Flags: 1}
+	child := &Span{Name: "GET /c", StatusCode: 200, TraceState: "a=b"}
+	child.ParentSpanID[0] = 1
+	ex.ExportSpan(root)
+	ex.ExportSpan(child)
+	if err := ex.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines %q", lines)
+	}
+	for i, l := range lines {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &v); err != nil {
+			t.Errorf("line %d: %v in %s", i, err, l)
+		}
+	}
+	if strings.Contains(lines[0], "parentSpanId") || !strings.Contains(lines[0], `"status":{"code":2}`) {
+		t.Errorf("root span %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"parentSpanId":"0100000000000000"`) || !strings.Contains(lines[1], `"traceState":"a=b"`) {
+		t.Errorf("child span %s", lines[1])
+	}
+}
@@ -0,0 +1,219 @@
+package http1
+
+import (
+	"bytes"
+	"sync"
+)
+
+// URI is the parsed request target, it handles the origin, absolute,
+// authority (CONNECT) and asterisk (OPTIONS *) forms.
+// Slices returned by its methods are valid until the URI is parsed again or reset
+type URI struct {
+	pathOriginal []byte
+	path         []byte
+	queryString  []byte
+	scheme       []byte
+	host         []byte
+	asterisk     bool
+	authority    bool
+}
+
+var uriPool sync.Pool
+
+func AcquireURI() *URI {
+	v := uriPool.Get()
+	if v == nil {
+		return &URI{}
+	}
+	return v.(*URI)
+}
+
+func ReleaseURI(u *URI) {
+	u.Reset()
+	uriPool.Put(u)
+}
+
+func (u *URI) Reset() {
+	u.pathOriginal = nil
+	u.path = u.path[:0]
+	u.queryString = nil
+	u.scheme = u.scheme[:0]
+	u.host = u.host[:0]
+	u.asterisk = false
+	u.authority = false
+}
+
+// Parse parses the request target, host is the Host header and is only used
+// when the target carries no authority itself
+func (u *URI) Parse(host, target []byte) {
+	u.Reset()
+	if n := bytes.IndexByte(target, '#'); n >= 0 {
+		target = target[:n]
+	}
+	scheme := byteHTTP
+	switch {
+	case len(target) == 1 && target[0] == '*':
+		u.asterisk = true
+		u.pathOriginal = target
+	case len(target) > 0 && target[0] == '/':
+	case bytes.Index(target, byteColonSlashSlash) > 0:
+		n := bytes.Index(target, byteColonSlashSlash)
+		scheme = target[:n]
+		target = target[n+len(byteColonSlashSlash):]
+		n = bytes.IndexAny(target, "/?")
+		if n < 0 {
+			n = len(target)
+		}
+		host = target[:n]
+		if at := bytes.LastIndex(host, byteAt); at >= 0 {
+			host = host[at+1:]
+		}
+		target = target[n:]
+	default:
+		u.authority = true
+		host = target
+		target = nil
+	}
+	u.scheme = appendLower(u.scheme, scheme)
+	u.host = appendLower(u.host, host)
+	if u.asterisk || u.authority {
+		return
+	}
+
+	if n := bytes.IndexByte(target, '?'); n >= 0 {
+		u.queryString = target[n+1:]
+		target = target[:n]
+	}
+	u.pathOriginal = target
+	u.path = normalizePath(u.path, target)
+}
+
+// Path returns the decoded path with dot segments and duplicate slashes removed,
+// "*" for the asterisk form and nothing for the authority form
+func (u *URI) Path() []byte {
+	if u.asterisk {
+		return u.pathOriginal
+	}
+	return u.path
+}
+
+// PathOriginal returns the path as sent by the client
+func (u *URI) PathOriginal() []byte {
+	return u.pathOriginal
+}
+
+// QueryString returns the raw query without the '?'
+func (u *URI) QueryString() []byte {
+	return u.queryString
+}
+
+// Host returns the lower case host and port from the target or the Host header
+func (u *URI) Host() []byte {
+	return u.host
+}
+
+// Scheme returns the lower case scheme, http unless the target is in absolute form
+func (u *URI) Scheme() []byte {
+	return u.scheme
+}
+
+func (u *URI) IsAsterisk() bool {
+	return u.asterisk
+}
+
+// IsAuthority reports whether the target is host:port as sent with CONNECT
+func (u *URI) IsAuthority() bool {
+	return u.authority
+}
+
+func appendLower(dst, src []byte) []byte {
+	for _, c := range src {
+		dst = append(dst, toLower(c))
+	}
+	return dst
+}
+
+// normalizePath appends the decoded src to dst[:0], then collapses duplicate
+// slashes and removes dot segments in place
+func normalizePath(dst, src []byte) []byte {
+	dst = dst[:0]
+	if len(src) == 0 || src[0] != '/' {
+		dst = append(dst, byteSlash...)
+	}
+	dst = appendUnescaped(dst, src)
+
+	b := dst
+	for {
+		n := bytes.Index(b, byteSlashSlash)
+		if n < 0 {
+			break
+		}
+		b = append(b[:n], b[n+1:]...)
+	}
+
+	return removeDotSegments(b)
+}
+
+// removeDotSegments removes '.' and '..' segments in place from a path starting with '/'
+func removeDotSegments(b []byte) []byte {
+	for {
+		n := bytes.Index(b, byteSlashDotSlash)
+		if n < 0 {
+			break
+		}
+		b = append(b[:n], b[n+len(byteSlashDotSlash)-1:]...)
+	}
+
+	for {
+		n := bytes.Index(b, byteSlashDotDotSlash)
+		if n < 0 {
+			break
+		}
+		nn := bytes.LastIndexByte(b[:n], '/')
+		if nn < 0 {
+			nn = 0
+		}
+		b = append(b[:nn], b[n+len(byteSlashDotDotSlash)-1:]...)
+	}
+
+	if bytes.HasSuffix(b, byteSlashDotDot) {
+		n := len(b) - len(byteSlashDotDot)
+		nn := bytes.LastIndexByte(b[:n], '/')
+		if nn < 0 {
+			nn = 0
+		}
+		b = b[:nn+1]
+	} else if len(b) >= 2 && b[len(b)-2] == '/' && b[len(b)-1] == '.' {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// appendUnescaped appends src to dst decoding %XX escapes, invalid escapes are kept as is
+func appendUnescaped(dst, src []byte) []byte {
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if c == '%' && i+2 < len(src) {
+			h, ok1 := unhex(src[i+1])
+			l, ok2 := unhex(src[i+2])
+			if ok1 && ok2 {
+				c = h<<4 | l
+				i += 2
+			}
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
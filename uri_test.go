@@ -0,0 +1,76 @@
+package http1
+
+import (
+	"testing"
+)
+
+func TestURIParse(t *testing.T) {
+	tests := []struct {
+		target    string
+		path      string
+		original  string
+		query     string
+		host      string
+		scheme    string
+		asterisk  bool
+		authority bool
+	}{
+		{"/a//b/./c/../d%2fe/%2e%2e/f?x=1#frag", "/a/b/d/f", "/a//b/./c/../d%2fe/%2e%2e/f", "x=1", "ex.com", "http", false, false},
+		{"HTTP://user@Foo.COM:8080/x/..?q", "/", "/x/..", "q", "foo.com:8080", "http", false, false},
+		{"https://foo.com", "/", "", "", "foo.com", "https", false, false},
+		{"foo.com:443", "", "", "", "foo.com:443", "http", false, true},
+		{"*", "*", "*", "", "ex.com", "http", true, false},
+		{"/../../a/.", "/a/", "/../../a/.", "", "ex.com", "http", false, false},
+		{"/a/b/..", "/a/", "/a/b/..", "", "ex.com", "http", false, false},
+		{"//evil.com", "/evil.com", "//evil.com", "", "ex.com", "http", false, false},
+		{"/%zz%4", "/%zz%4", "/%zz%4", "", "ex.com", "http", false, false},
+	}
+	u := AcquireURI()
+	defer ReleaseURI(u)
+	for _, tt := range tests {
+		u.Parse([]byte("Ex.com"), []byte(tt.target))
+		got := []string{string(u.Path()), string(u.PathOriginal()), string(u.QueryString()), string(u.Host()), string(u.Scheme())}
+		want := []string{tt.path, tt.original, tt.query, tt.host, tt.scheme}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("Parse(%q): got path=%q orig=%q query=%q host=%q scheme=%q", tt.target, got[0], got[1], got[2], got[3], got[4])
+				break
+			}
+		}
+		if u.IsAsterisk() != tt.asterisk || u.IsAuthority() != tt.authority {
+			t.Errorf("Parse(%q): asterisk %v authority %v", tt.target, u.IsAsterisk(), u.IsAuthority())
+		}
+	}
+}
+
+func TestURIParseAllocs(t *testing.T) {
+	u := AcquireURI()
+	defer ReleaseURI(u)
+	host, target := []byte("ex.com"), []byte("/a//b/./c/../d?x")
+	u.Parse(host, target)
+	if n := testing.AllocsPerRun(100, func() { u.Parse(host, target) }); n > 0 {
+		t.Errorf("Parse allocates %v times", n)
+	}
+}
+
+func TestRequestTargetForm(t *testing.T) {
+	s := NewServer(func(ctx *Context) {}, 0)
+	tests := []struct {
+		raw    string
+		status int
+	}{
+		{"GET example.com:80 HTTP/1.1\r\nHost: a\r\n\r\n", StatusBadRequest},
+		{"GET * HTTP/1.1\r\nHost: a\r\n\r\n", StatusBadRequest},
+		{"CONNECT /x HTTP/1.1\r\nHost: a\r\n\r\n", StatusBadRequest},
+		{"CONNECT http://a/ HTTP/1.1\r\nHost: a\r\n\r\n", StatusBadRequest},
+		{"OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n", StatusOK},
+		{"GET http://a/x HTTP/1.1\r\nHost: a\r\n\r\n", StatusOK},
+		{"CONNECT a:443 HTTP/1.1\r\nHost: a\r\n\r\n", StatusOK},
+	}
+	for _, tt := range tests {
+		out, _ := serveString(s, tt.raw)
+		if resp := readResponses(t, out, "GET")[0]; resp.StatusCode != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.raw, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -23,6 +23,50 @@ func s2b(s string) (b []byte) {
 	return *(*[]byte)(unsafe.Pointer(&h))
 }
 
+// appendCanonicalKey appends key in canonical form, the first letter and
+// any letter following a hyphen in upper case and the rest in lower case
+func appendCanonicalKey(dst []byte, key string) []byte {
+	upper := true
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		dst = append(dst, c)
+		upper = c == '-'
+	}
+	return dst
+}
+
+// equalFoldString reports whether a and b are equal under ASCII case folding
+func equalFoldString(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if toLower(a[i]) != toLower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func toLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func trimQuotes(b []byte) []byte {
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		return b[1 : len(b)-1]
+	}
+	return b
+}
+
 func appendLine(dst, key, value []byte) []byte {
 	dst = append(dst, key...)
 	dst = append(dst, byteColonSpace...)
@@ -52,7 +96,7 @@ func fixTransferEncoding(header httparse.Header) ([][]byte, error) {
 			break
 		}
 		if !bytes.Equal(encoding, byteChunked) {
-			return nil, errors.Errorf(fmt.Sprintf("unsupported transfer encoding: %q", encoding))
+			return nil, errors.Wrapf(ErrUnsupportedTransferEncoding, "%q", encoding)
 		}
 		tr = tr[0 : len(tr)+1]
 		tr[len(tr)-1] = encoding
@@ -85,6 +129,11 @@ func fixLength(isResponse bool, status int, requestMethod []byte,
 		contentLens = header[HeaderContentLength]
 	}
 
+	//bytes after a CONNECT request belong to the tunnel
+	if isRequest && bytes.Equal(requestMethod, byteConnect) {
+		return 0, nil
+	}
+
 	if !isResponse && bytes.Equal(requestMethod, byteHead) {
 		if isRequest && len(contentLens) > 0 && !(len(contentLens) == 1 && bytes.Equal(contentLens[0], []byte("0"))) {
 			return 0, fmt.Errorf("http: method cannot contain a Content-Length; got %q", contentLens)
@@ -150,18 +199,17 @@ func bufCopy(w io.Writer, r io.Reader) (int64, error) {
 	return n, err
 }
 
-func writeChunked(w *bufio.Writer, r io.Reader) error {
+// writeChunked copies r as chunks, the caller writes the last chunk
+func writeChunked(w *bufio.Writer, r io.Reader) (int64, error) {
 	buf := bufPool.Get().([]byte)
 
 	var err error
 	var n int
+	var written int64
 	for {
 		n, err = r.Read(buf)
 		if n == 0 {
 			if err == io.EOF {
-				if err = writeChunkBlock(w, buf[:0]); err != nil {
-					break
-				}
 				err = nil
 			}
 			break
@@ -169,9 +217,10 @@ func writeChunked(w *bufio.Writer, r io.Reader) error {
 		if err = writeChunkBlock(w, buf[:n]); err != nil {
 			break
 		}
+		written += int64(n)
 	}
 	bufPool.Put(buf)
-	return err
+	return written, err
 }
 
 func writeChunkBlock(w *bufio.Writer, b []byte) error {
@@ -0,0 +1,128 @@
+package http1
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// HeaderField is a response header added by a VirtualHost
+type HeaderField struct {
+	Key   string
+	Value []byte
+}
+
+// VirtualHost is one site served by VirtualHosts
+type VirtualHost struct {
+	Handler HandlerFunc
+	//Limits.MaxBodySize replaces the server limit for the host, the header limits
+	//of the server apply since the host is only known after the headers are parsed
+	Limits Limits
+	//Headers are added to every response before Handler runs
+	Headers []HeaderField
+}
+
+type wildcardHost struct {
+	suffix string //".example.com"
+	host   *VirtualHost
+}
+
+// VirtualHosts dispatches requests on the host of the request target or the Host header.
+// Hosts are matched exactly, then by the longest '*.example.com' wildcard, then Default.
+// Install both HeaderHandler and Handler on the Server so the host limits apply
+// before the body is read:
+//
+//	s.HeaderHandler = vhosts.HeaderHandler
+//	s.Handler = vhosts.Handler
+type VirtualHosts struct {
+	Default   *VirtualHost
+	hosts     map[string]*VirtualHost
+	wildcards []wildcardHost
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{
+		hosts: make(map[string]*VirtualHost),
+	}
+}
+
+// Add registers vh for pattern, a host name or '*.' followed by a domain
+func (v *VirtualHosts) Add(pattern string, vh *VirtualHost) {
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	if strings.HasPrefix(pattern, "*.") {
+		v.wildcards = append(v.wildcards, wildcardHost{suffix: pattern[1:], host: vh})
+		sort.SliceStable(v.wildcards, func(i, j int) bool {
+			return len(v.wildcards[i].suffix) > len(v.wildcards[j].suffix)
+		})
+		return
+	}
+	v.hosts[pattern] = vh
+}
+
+// Lookup returns the VirtualHost for a lower case host, which may carry a port
+func (v *VirtualHosts) Lookup(host []byte) *VirtualHost {
+	host = normalizeHost(host)
+	if vh, ok := v.hosts[string(host)]; ok {
+		return vh
+	}
+	for i := range v.wildcards {
+		suffix := v.wildcards[i].suffix
+		if len(host) > len(suffix) && strings.HasSuffix(b2s(host), suffix) {
+			return v.wildcards[i].host
+		}
+	}
+	return v.Default
+}
+
+// HeaderHandler answers 400 to HTTP/1.1 requests without Host and 404 to unknown hosts,
+// otherwise the body limit of the host is applied
+func (v *VirtualHosts) HeaderHandler(ctx *Context) bool {
+	vh := v.match(ctx)
+	if vh == nil {
+		return false
+	}
+	if vh.Limits.MaxBodySize > 0 {
+		ctx.req.Set(vh.Limits.MaxBodySize)
+	}
+	return true
+}
+
+func (v *VirtualHosts) Handler(ctx *Context) {
+	vh := v.match(ctx)
+	if vh == nil {
+		return
+	}
+	for i := range vh.Headers {
+		ctx.resp.header.Add(vh.Headers[i].Key, vh.Headers[i].Value)
+	}
+	vh.Handler(ctx)
+}
+
+func (v *VirtualHosts) match(ctx *Context) *VirtualHost {
+	header := &ctx.req.header
+	if _, ok := header.Headers[HeaderHost]; !ok && header.HTTP11 {
+		ctx.resp.SetStatusCode(StatusBadRequest)
+		ctx.resp.SetBody(s2b("missing Host header"))
+		return nil
+	}
+	vh := v.Lookup(ctx.req.uri.Host())
+	if vh == nil || vh.Handler == nil {
+		ctx.resp.SetStatusCode(StatusNotFound)
+		return nil
+	}
+	return vh
+}
+
+// normalizeHost strips the port and a trailing dot from a lower case host
+func normalizeHost(host []byte) []byte {
+	if len(host) > 0 && host[0] == '[' {
+		if n := bytes.IndexByte(host, ']'); n > 0 {
+			return host[:n+1]
+		}
+		return host
+	}
+	if n := bytes.LastIndexByte(host, ':'); n >= 0 {
+		host = host[:n]
+	}
+	return bytes.TrimSuffix(host, []byte("."))
+}
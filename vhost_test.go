@@ -0,0 +1,88 @@
+package http1
+
+import (
+	"testing"
+)
+
+func newTestVirtualHosts() *VirtualHosts {
+	v := NewVirtualHosts()
+	site := func(name string) *VirtualHost {
+		return &VirtualHost{
+			Handler: func(ctx *Context) { ctx.Response().SetBody([]byte(name)) },
+			Headers: []HeaderField{{"X-Site", []byte(name)}},
+		}
+	}
+	v.Add("Example.com", site("exact"))
+	v.Add("*.example.com", site("wild"))
+	v.Add("*.api.example.com", site("api"))
+	small := site("small")
+	small.Limits.MaxBodySize = 2
+	v.Add("small.org", small)
+	return v
+}
+
+func TestVirtualHostsLookup(t *testing.T) {
+	v := newTestVirtualHosts()
+	tests := []struct {
+		host string
+		site string
+	}{
+		{"example.com", "exact"},
+		{"example.com:8080", "exact"},
+		{"example.com.", "exact"},
+		{"a.b.example.com", "wild"},
+		{"x.api.example.com", "api"},
+		{"api.example.com", "wild"},
+		{"badexample.com", ""},
+		{"[::1]:80", ""},
+	}
+	for _, tt := range tests {
+		vh := v.Lookup([]byte(tt.host))
+		site := ""
+		if vh != nil {
+			site = string(vh.Headers[0].Value)
+		}
+		if site != tt.site {
+			t.Errorf("Lookup(%q) = %q, want %q", tt.host, site, tt.site)
+		}
+	}
+}
+
+func TestVirtualHostsDispatch(t *testing.T) {
+	v := newTestVirtualHosts()
+	s := NewServer(v.Handler, 0)
+	s.HeaderHandler = v.HeaderHandler
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+		body   string
+	}{
+		{"host header", "GET / HTTP/1.1\r\nHost: Example.COM:8080\r\n\r\n", 200, "exact"},
+		{"absolute form wins", "GET http://a.example.com/ HTTP/1.1\r\nHost: other\r\n\r\n", 200, "wild"},
+		{"unknown host", "GET / HTTP/1.1\r\nHost: other\r\n\r\n", 404, ""},
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", 400, ""},
+		{"http/1.0 without host", "GET / HTTP/1.0\r\n\r\n", 404, ""},
+		{"host body limit", "POST / HTTP/1.1\r\nHost: small.org\r\nContent-Length: 3\r\n\r\nabc", 413, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := serveString(s, tt.raw)
+			resp := readResponses(t, out, "GET")[0]
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" {
+				if body := readBody(resp); body != tt.body || resp.Header.Get("X-Site") != tt.body {
+					t.Errorf("body %q X-Site %q, want %q", body, resp.Header.Get("X-Site"), tt.body)
+				}
+			}
+		})
+	}
+
+	v.Default = &VirtualHost{Handler: func(ctx *Context) { ctx.Response().SetBody([]byte("default")) }}
+	out, _ := serveString(s, "GET / HTTP/1.1\r\nHost: other\r\n\r\n")
+	if body := readBody(readResponses(t, out, "GET")[0]); body != "default" {
+		t.Errorf("default host body %q", body)
+	}
+}